@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
 )
 
 var target = flag.String("target", "http://localhost:8090", "request target")
@@ -16,11 +18,15 @@ func main() {
 	client.Timeout = 10 * time.Second
 
 	for range time.Tick(1 * time.Second) {
-		resp, err := client.Get(fmt.Sprintf("%s/api/v1/some-data", *target))
+		id := httptools.NewRequestID()
+		req, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/some-data", *target), nil)
+		req.Header.Set(httptools.RequestIDHeader, id)
+		resp, err := client.Do(req)
 		if err == nil {
-			log.Printf("response %d", resp.StatusCode)
+			resp.Body.Close()
+			log.Printf("response %d id %s", resp.StatusCode, id)
 		} else {
-			log.Printf("error %s", err)
+			log.Printf("error %s id %s", err, id)
 		}
 	}
 }
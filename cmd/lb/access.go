@@ -0,0 +1,133 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	forwardedForHeader = "X-Forwarded-For"
+
+	// globalAccessScope counts requests turned away by the global lists,
+	// the ones turned away by a route are counted under its prefix.
+	globalAccessScope = "global"
+)
+
+var (
+	accessDenied = expvar.NewMap("lb_access_denied_total")
+	access       = new(accessControl)
+)
+
+// accessConfig limits the client networks let through, globally or on a
+// route. Entries are addresses or CIDRs.
+type accessConfig struct {
+	// Allow, if not empty, lists the only networks let through.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists networks turned away even if Allow has them.
+	Deny []string `json:"deny,omitempty"`
+
+	allow, deny []*net.IPNet
+}
+
+func (ac *accessConfig) parse() error {
+	var err error
+	if ac.allow, err = parseCIDRs(strings.Join(ac.Allow, ",")); err != nil {
+		return fmt.Errorf("access allow: %s", err)
+	}
+	if ac.deny, err = parseCIDRs(strings.Join(ac.Deny, ",")); err != nil {
+		return fmt.Errorf("access deny: %s", err)
+	}
+	return nil
+}
+
+// allows tells whether ip may pass. Clients without an IP, like those on
+// Unix sockets, only pass when there is no allow list.
+func (ac *accessConfig) allows(ip net.IP) bool {
+	if ip != nil && networksContain(ac.deny, ip) {
+		return false
+	}
+	return len(ac.allow) == 0 || ip != nil && networksContain(ac.allow, ip)
+}
+
+// accessControl holds the global lists and the proxies trusted to report
+// the client address, both replaced on config reload.
+type accessControl struct {
+	mux     sync.RWMutex
+	global  accessConfig
+	trusted []*net.IPNet
+}
+
+func (a *accessControl) set(global accessConfig, trusted []*net.IPNet) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.global, a.trusted = global, trusted
+}
+
+// clientIP is the address r comes from: the peer, or if the peer is a
+// trusted proxy, the last X-Forwarded-For hop not added by one.
+func (a *accessControl) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	if ip == nil || !networksContain(a.trusted, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values(forwardedForHeader), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !networksContain(a.trusted, ip) {
+			break
+		}
+	}
+	return ip
+}
+
+// check tells whether r may use route and if not, where it was denied.
+func (a *accessControl) check(r *http.Request, route *routeConfig) (string, bool) {
+	ip := a.clientIP(r)
+	a.mux.RLock()
+	global := a.global
+	a.mux.RUnlock()
+	if !global.allows(ip) {
+		return globalAccessScope, false
+	}
+	if route.Access != nil && !route.Access.allows(ip) {
+		return route.Prefix, false
+	}
+	return "", true
+}
+
+// allowsConn applies the global lists to a connection proxied in tcp mode.
+func (a *accessControl) allowsConn(conn net.Conn) bool {
+	var ip net.IP
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	a.mux.RLock()
+	defer a.mux.RUnlock()
+	if !a.global.allows(ip) {
+		accessDenied.Add(globalAccessScope, 1)
+		return false
+	}
+	return true
+}
+
+func writeForbidden(rw http.ResponseWriter, r *http.Request, info *requestInfo) {
+	if isGRPC(r) {
+		writeGRPCError(rw, grpcPermissionDenied, "client address not allowed")
+		return
+	}
+	writeProblem(rw, r, info, http.StatusForbidden, fmt.Sprintf("Requests from %s are not allowed.", access.clientIP(r)))
+}
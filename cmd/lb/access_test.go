@@ -0,0 +1,113 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientIP(t *testing.T) {
+	assert := assert.New(t)
+
+	trusted, _ := parseCIDRs("10.0.0.0/8, 192.0.2.1")
+	defer access.set(accessConfig{}, nil)
+	access.set(accessConfig{}, trusted)
+
+	cases := []struct {
+		remote, forwarded, want string
+	}{
+		{"203.0.113.7:5000", "", "203.0.113.7"},
+		{"203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+		{"10.1.2.3:5000", "198.51.100.1", "198.51.100.1"},
+		{"10.1.2.3:5000", "1.1.1.1, 198.51.100.1, 192.0.2.1", "198.51.100.1"},
+		{"10.1.2.3:5000", "garbage, 10.4.4.4", "10.4.4.4"},
+		{"10.1.2.3:5000", "", "10.1.2.3"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set(forwardedForHeader, c.forwarded)
+		}
+		assert.Equal(c.want, access.clientIP(r).String(), "%s via %s", c.forwarded, c.remote)
+		assert.Equal(c.want, clientIP(r))
+	}
+}
+
+func deniedCount(scope string) int64 {
+	if v, ok := accessDenied.Get(scope).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestAccessLists(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(backend))
+
+	dir, err := ioutil.TempDir("", "test-access")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.json")
+	apply := func(data string) {
+		assert.Nil(ioutil.WriteFile(path, []byte(data), 0o600))
+		cfg, err := loadConfig(path)
+		if assert.Nil(err) {
+			applyConfig(cfg)
+		}
+	}
+	defer applyConfig(&config{})
+	send := func(remote, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = remote
+		r.Header.Set(forwardedForHeader, "127.0.0.1")
+		rw := httptest.NewRecorder()
+		handleRequest(rw, r)
+		return rw
+	}
+
+	apply(`{
+		"access": {"deny": ["203.0.113.0/24"]},
+		"routes": [{"prefix": "/admin/", "access": {"allow": ["10.0.0.0/8", "192.0.2.1"], "deny": ["10.6.6.6"]}}]
+	}`)
+	globalBefore, routeBefore := deniedCount(globalAccessScope), deniedCount("/admin/")
+
+	rw := send("203.0.113.7:5000", "/api/v1/some-data")
+	assert.Equal(http.StatusForbidden, rw.Code)
+	assert.Equal(problemContentType, rw.Header().Get("Content-Type"))
+	assert.Contains(rw.Body.String(), "203.0.113.7")
+	assert.Equal(http.StatusOK, send("198.51.100.1:5000", "/api/v1/some-data").Code)
+	assert.Equal(http.StatusForbidden, send("198.51.100.1:5000", "/admin/servers").Code)
+	assert.Equal(http.StatusOK, send("10.1.2.3:5000", "/admin/servers").Code)
+	assert.Equal(http.StatusOK, send("192.0.2.1:5000", "/admin/servers").Code)
+	assert.Equal(http.StatusForbidden, send("10.6.6.6:5000", "/admin/servers").Code)
+
+	assert.Equal(globalBefore+1, deniedCount(globalAccessScope))
+	assert.Equal(routeBefore+2, deniedCount("/admin/"))
+
+	// Lists change on reload, and a trusted proxy reports the client.
+	apply(`{"access": {"allow": ["198.51.100.0/24"]}, "trustedProxies": ["203.0.113.0/24"]}`)
+	assert.Equal(http.StatusForbidden, send("192.0.2.1:5000", "/api/v1/some-data").Code)
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	r.RemoteAddr = "203.0.113.7:5000"
+	r.Header.Set(forwardedForHeader, "198.51.100.1")
+	rw = httptest.NewRecorder()
+	handleRequest(rw, r)
+	assert.Equal(http.StatusOK, rw.Code)
+
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"access": {"deny": ["10.0.0.0/33"]}}`), 0o600))
+	_, err = loadConfig(path)
+	assert.NotNil(err)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
+	"github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
+)
+
+const (
+	logFormatJSON     = "json"
+	logFormatCommon   = "common"
+	logFormatCombined = "combined"
+)
+
+type requestInfo struct {
+	id              string
+	start           time.Time
+	backend         string
+	attempts        int
+	upstreamLatency time.Duration
+	span            *tracing.Span
+	route           *routeConfig
+	timeouts        timeoutConfig
+}
+
+type accessEntry struct {
+	Time            time.Time `json:"time"`
+	RequestID       string    `json:"request_id"`
+	ClientIP        string    `json:"client_ip"`
+	Method          string    `json:"method"`
+	Path            string    `json:"path"`
+	Proto           string    `json:"-"`
+	Referer         string    `json:"-"`
+	UserAgent       string    `json:"-"`
+	Backend         string    `json:"backend"`
+	Attempts        int       `json:"attempts"`
+	UpstreamLatency float64   `json:"upstream_latency_ms"`
+	Latency         float64   `json:"latency_ms"`
+	Status          int       `json:"status"`
+	Bytes           int64     `json:"bytes"`
+}
+
+type accessLogger struct {
+	format string
+	path   string
+	sample float64
+
+	mux sync.Mutex
+	out io.Writer
+}
+
+func newAccessLogger(path, format string, sample float64) (*accessLogger, error) {
+	switch format {
+	case logFormatJSON, logFormatCommon, logFormatCombined:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	if sample < 0 || sample > 1 {
+		return nil, fmt.Errorf("access log sample rate must be within [0, 1], got %v", sample)
+	}
+	l := &accessLogger{format: format, path: path, sample: sample, out: os.Stdout}
+	if err := l.reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// reopen closes the current log file and opens it again at the same path,
+// so that logrotate can move the old file away and signal us with SIGHUP.
+func (l *accessLogger) reopen() error {
+	if l.path == "" || l.path == "-" {
+		return nil
+	}
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if old, ok := l.out.(*os.File); ok && old != os.Stdout {
+		old.Close()
+	}
+	l.out = f
+	return nil
+}
+
+func (l *accessLogger) sampled(status int) bool {
+	if status >= http.StatusInternalServerError || l.sample >= 1 {
+		return true
+	}
+	return mathrand.Float64() < l.sample
+}
+
+func (l *accessLogger) log(e *accessEntry) {
+	if l == nil || !l.sampled(e.Status) {
+		return
+	}
+	line := l.formatEntry(e)
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	_, _ = io.WriteString(l.out, line)
+}
+
+func (l *accessLogger) formatEntry(e *accessEntry) string {
+	if l.format == logFormatJSON {
+		data, _ := json.Marshal(e)
+		return string(data) + "\n"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - - [%s] \"%s %s %s\" %d %d",
+		dash(e.ClientIP), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, e.Bytes)
+	if l.format == logFormatCombined {
+		fmt.Fprintf(&b, " %q %q", dash(e.Referer), dash(e.UserAgent))
+	}
+	fmt.Fprintf(&b, " rid=%s backend=%s attempts=%d upstream=%.3f total=%.3f\n",
+		dash(e.RequestID), dash(e.Backend), e.Attempts, e.UpstreamLatency/1000, e.Latency/1000)
+	return b.String()
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// requestID keeps the ID the client sent and makes up one otherwise.
+func requestID(r *http.Request) string {
+	if id := httptools.RequestID(r); id != "" {
+		return id
+	}
+	return httptools.NewRequestID()
+}
+
+func clientIP(r *http.Request) string {
+	if ip := access.clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return r.RemoteAddr
+}
+
+func newAccessEntry(r *http.Request, info *requestInfo, status int, bytes int64) *accessEntry {
+	return &accessEntry{
+		Time:            info.start,
+		RequestID:       info.id,
+		ClientIP:        clientIP(r),
+		Method:          r.Method,
+		Path:            r.URL.RequestURI(),
+		Proto:           r.Proto,
+		Referer:         r.Referer(),
+		UserAgent:       r.UserAgent(),
+		Backend:         info.backend,
+		Attempts:        info.attempts,
+		UpstreamLatency: milliseconds(info.upstreamLatency),
+		Latency:         milliseconds(time.Since(info.start)),
+		Status:          status,
+		Bytes:           bytes,
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(data)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testAccessEntry() *accessEntry {
+	return &accessEntry{
+		Time:            time.Date(2021, 5, 1, 10, 0, 0, 0, time.UTC),
+		RequestID:       "abc",
+		ClientIP:        "10.0.0.1",
+		Method:          "GET",
+		Path:            "/api/v1/some-data",
+		Proto:           "HTTP/1.1",
+		UserAgent:       "test",
+		Backend:         "server1:8080",
+		Attempts:        1,
+		UpstreamLatency: 12,
+		Latency:         15,
+		Status:          200,
+		Bytes:           10,
+	}
+}
+
+func TestAccessLogFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	l := &accessLogger{format: logFormatJSON}
+	var decoded map[string]interface{}
+	assert.Nil(json.Unmarshal([]byte(l.formatEntry(testAccessEntry())), &decoded))
+	assert.Equal("abc", decoded["request_id"])
+	assert.Equal("server1:8080", decoded["backend"])
+	assert.Equal(float64(200), decoded["status"])
+
+	l.format = logFormatCommon
+	assert.Equal(`10.0.0.1 - - [01/May/2021:10:00:00 +0000] "GET /api/v1/some-data HTTP/1.1" 200 10`+
+		" rid=abc backend=server1:8080 attempts=1 upstream=0.012 total=0.015\n", l.formatEntry(testAccessEntry()))
+
+	l.format = logFormatCombined
+	assert.Contains(l.formatEntry(testAccessEntry()), `200 10 "-" "test" rid=abc`)
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	assert := assert.New(t)
+
+	l := &accessLogger{sample: 0}
+	assert.False(l.sampled(200))
+	assert.True(l.sampled(503))
+
+	l.sample = 1
+	assert.True(l.sampled(200))
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-access-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	l, err := newAccessLogger(path, logFormatJSON, 1)
+	assert.Nil(err)
+	l.log(testAccessEntry())
+
+	assert.Nil(os.Rename(path, path+".1"))
+	assert.Nil(l.reopen())
+	l.log(testAccessEntry())
+
+	rotated, _ := ioutil.ReadFile(path + ".1")
+	current, _ := ioutil.ReadFile(path)
+	assert.Equal(1, strings.Count(string(rotated), "\n"))
+	assert.Equal(1, strings.Count(string(current), "\n"))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	adaptiveInitialLimit = 10
+	adaptiveWindow       = 100
+	adaptiveBackoff      = 0.9
+
+	priorityLow = "low"
+	// lowPriorityShare is the part of a server's limit that low-priority
+	// requests may use, the rest is kept for everyone else.
+	lowPriorityShare = 0.8
+)
+
+var errShed = errors.New("low-priority request shed under load")
+
+var shedRequests = expvar.NewInt("lb_shed_total")
+
+// aimdLimit learns how many concurrent requests a server takes before it
+// slows down. Every response close to the baseline latency raises the
+// limit by 1/limit, about one per round of requests, while a response
+// slower than tolerance times the baseline or a timeout cuts it by a
+// tenth. The baseline is the fastest response of the previous window, so
+// it follows a server that got slower for good.
+type aimdLimit struct {
+	limit     float64
+	max       float64
+	tolerance float64
+
+	baseline  time.Duration
+	windowMin time.Duration
+	samples   int
+}
+
+func newAIMDLimit(max int, tolerance float64) *aimdLimit {
+	return &aimdLimit{
+		limit:     math.Min(adaptiveInitialLimit, float64(max)),
+		max:       float64(max),
+		tolerance: tolerance,
+	}
+}
+
+func (a *aimdLimit) observe(latency time.Duration, timedOut bool) {
+	if !timedOut {
+		if a.windowMin == 0 || latency < a.windowMin {
+			a.windowMin = latency
+		}
+		if a.baseline == 0 || latency < a.baseline {
+			a.baseline = latency
+		}
+		if a.samples++; a.samples >= adaptiveWindow {
+			a.baseline, a.windowMin, a.samples = a.windowMin, 0, 0
+		}
+	}
+
+	if timedOut || float64(latency) > a.tolerance*float64(a.baseline) {
+		a.limit = math.Max(1, a.limit*adaptiveBackoff)
+	} else {
+		a.limit = math.Min(a.max, a.limit+1/a.limit)
+	}
+}
+
+type priorityKey struct{}
+
+func withLowPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priorityLow)
+}
+
+func isLowPriority(ctx context.Context) bool {
+	return ctx.Value(priorityKey{}) == priorityLow
+}
+
+// lowPriority reports whether the request or its route asks to be shed
+// before other requests.
+func lowPriority(r *http.Request, route *routeConfig) bool {
+	if route.Priority == priorityLow {
+		return true
+	}
+	return *priorityHeader != "" && strings.EqualFold(r.Header.Get(*priorityHeader), priorityLow)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAIMDLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAIMDLimit(20, 2)
+	assert.Equal(10.0, a.limit)
+	for i := 0; i < 50; i++ {
+		a.observe(10*time.Millisecond, false)
+	}
+	assert.True(a.limit > 13, "fast responses raise the limit, got %v", a.limit)
+
+	grown := a.limit
+	a.observe(50*time.Millisecond, false)
+	assert.InDelta(grown*adaptiveBackoff, a.limit, 0.001)
+	a.observe(0, true)
+	assert.InDelta(grown*adaptiveBackoff*adaptiveBackoff, a.limit, 0.001)
+
+	for i := 0; i < 1000; i++ {
+		a.observe(10*time.Millisecond, false)
+	}
+	assert.Equal(20.0, a.limit, "limits stay under the maximum")
+	for i := 0; i < 100; i++ {
+		a.observe(time.Second, true)
+	}
+	assert.Equal(1.0, a.limit, "limits stay over one")
+
+	// A server that slowed down for good becomes the new baseline.
+	for i := 0; i < 2*adaptiveWindow; i++ {
+		a.observe(40*time.Millisecond, false)
+	}
+	assert.Equal(40*time.Millisecond, a.baseline)
+	assert.True(a.limit > 1)
+}
+
+func TestLimiterShedsLowPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	servers := parseHosts("server1:8080")
+	l := newLimiter(5, 10, 10*time.Millisecond)
+	low := withLowPriority(context.Background())
+
+	for i := 0; i < 4; i++ {
+		_, err := l.acquire(low, servers)
+		assert.Nil(err)
+	}
+	_, err := l.acquire(low, servers)
+	assert.Equal(errShed, err, "low-priority requests leave a share of the limit to others")
+	_, err = l.acquire(context.Background(), servers)
+	assert.Nil(err)
+	_, err = l.acquire(context.Background(), servers)
+	assert.Equal(errQueueTimeout, err, "other requests wait in the queue")
+}
+
+func TestLimiterLearnsLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	servers := parseHosts("server1:8080")
+	l := newLimiter(0, 0, 0)
+	l.enableAdaptive(4, 2)
+	for i := 0; i < 4; i++ {
+		_, err := l.acquire(context.Background(), servers)
+		assert.Nil(err)
+	}
+	_, err := l.acquire(context.Background(), servers)
+	assert.Equal(errQueueFull, err)
+
+	l.observe(servers[0], 10*time.Millisecond, nil)
+	l.observe(servers[0], 100*time.Millisecond, nil)
+	assert.InDelta(4*adaptiveBackoff, l.learnedLimits()["server1:8080"], 0.01)
+	l.observe(servers[0], time.Second, &timeoutError{phase: "response header"})
+	l.observe(servers[0], time.Second, &timeoutError{phase: "idle body"})
+	l.observe(servers[0], time.Second, errNoHealthyServers)
+	assert.InDelta(4*adaptiveBackoff*adaptiveBackoff*adaptiveBackoff, l.learnedLimits()["server1:8080"], 0.01)
+	l.release(servers[0])
+	_, err = l.acquire(context.Background(), servers)
+	assert.Equal(errQueueFull, err, "a lowered limit keeps slots freed by releases")
+}
+
+func TestLowPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "/api", nil)
+	assert.False(lowPriority(r, defaultRoute))
+	r.Header.Set("X-Priority", "Low")
+	assert.True(lowPriority(r, defaultRoute))
+	assert.True(lowPriority(httptest.NewRequest("GET", "/reports", nil), &routeConfig{Prefix: "/reports", Priority: priorityLow}))
+}
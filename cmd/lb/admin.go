@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
+)
+
+func adminHandler() http.Handler {
+	h := new(http.ServeMux)
+	h.Handle("/debug/vars", expvar.Handler())
+	h.HandleFunc("/canary", handleCanary)
+	h.HandleFunc("/servers", handleServers)
+	h.HandleFunc("/servers/drain", handleDrain)
+	return h
+}
+
+func startAdmin(port int) httptools.Server {
+	if port == 0 {
+		return nil
+	}
+	l, err := listenAdmin(port)
+	if err != nil {
+		log.Fatalf("Failed to listen for admin requests: %s", err)
+	}
+	admin := httptools.CreateServerOn([]net.Listener{l}, adminHandler(), "", "")
+	admin.Start()
+	return admin
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+func handleCanary(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var cfg canaryConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := cfg.validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		canary.set(cfg)
+	default:
+		rw.Header().Set("Allow", "GET, PUT")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(rw, http.StatusOK, canary.current())
+}
+
+type serverStatus struct {
+	Host     string `json:"host"`
+	Pool     string `json:"pool"`
+	Tier     int    `json:"tier"`
+	Zone     string `json:"zone,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Draining bool   `json:"draining"`
+	Traffic  int    `json:"traffic"`
+	InFlight int    `json:"inFlight"`
+}
+
+func handleServers(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		rw.Header().Set("Allow", "GET")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// Slow admin clients must not hold up requests waiting for the lock.
+	backendLimiter.mux.Lock()
+	res := []serverStatus{}
+	for _, s := range allServers() {
+		res = append(res, serverStatus{
+			Host:     s.host,
+			Pool:     poolOf(s).name,
+			Tier:     s.tier,
+			Zone:     s.zone,
+			Healthy:  s.isHealthy,
+			Draining: s.draining,
+			Traffic:  s.traffic,
+			InFlight: s.inFlight,
+		})
+	}
+	backendLimiter.mux.Unlock()
+	writeJSON(rw, http.StatusOK, res)
+}
+
+// handleDrain stops new requests to ?host= on POST and resumes them on
+// DELETE. Clients pinned to a drained server move to another one.
+func handleDrain(rw http.ResponseWriter, r *http.Request) {
+	var drain bool
+	switch r.Method {
+	case http.MethodPost:
+		drain = true
+	case http.MethodDelete:
+	default:
+		rw.Header().Set("Allow", "POST, DELETE")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s := findServer(r.URL.Query().Get("host"))
+	if s == nil {
+		http.Error(rw, "unknown server", http.StatusNotFound)
+		return
+	}
+	backendLimiter.mux.Lock()
+	s.draining = drain
+	backendLimiter.mux.Unlock()
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+const affinityIDLen = 16
+
+// affinity pins clients to servers with a cookie holding an HMAC of the
+// server address, which tells nothing about the server and cannot be
+// forged without the secret.
+type affinity struct {
+	cookie string
+	secret []byte
+}
+
+func newAffinity(cookie, secret string) *affinity {
+	if cookie == "" {
+		return nil
+	}
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+	}
+	return &affinity{cookie: cookie, secret: key}
+}
+
+func (a *affinity) id(s *server) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(s.host))
+	return hex.EncodeToString(mac.Sum(nil))[:2*affinityIDLen]
+}
+
+// pinned returns the candidate named by the request cookie, if any.
+func (a *affinity) pinned(r *http.Request, candidates []*server) *server {
+	if a == nil {
+		return nil
+	}
+	cookie, err := r.Cookie(a.cookie)
+	if err != nil {
+		return nil
+	}
+	for _, s := range candidates {
+		if hmac.Equal([]byte(cookie.Value), []byte(a.id(s))) {
+			return s
+		}
+	}
+	return nil
+}
+
+// pinnedPool names the pool among stable and canary holding the server
+// named by the request cookie, empty if there is none.
+func (a *affinity) pinnedPool(r *http.Request) string {
+	switch {
+	case a.pinned(r, canaryPool) != nil:
+		return canaryPoolName
+	case a.pinned(r, serversPool) != nil:
+		return stablePoolName
+	}
+	return ""
+}
+
+// pin replaces any affinity cookie set by an earlier attempt.
+func (a *affinity) pin(rw http.ResponseWriter, r *http.Request, s *server) {
+	rw.Header().Del("Set-Cookie")
+	http.SetCookie(rw, &http.Cookie{
+		Name:     a.cookie,
+		Value:    a.id(s),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
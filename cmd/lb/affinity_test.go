@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffinity(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.Host))
+	}))
+	defer backend.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.Host))
+	}))
+	defer other.Close()
+
+	defer func(old []*server, oldStickiness *affinity) {
+		serversPool, stickiness = old, oldStickiness
+	}(serversPool, stickiness)
+	serversPool = parseHosts(backendHost(backend) + "," + backendHost(other))
+	stickiness = newAffinity("lb-affinity", "secret")
+
+	rw := httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/", nil))
+	cookies := rw.Result().Cookies()
+	assert.Len(cookies, 1)
+	first := rw.Body.String()
+
+	// Pinned requests ignore the balancing strategy and keep no new cookie.
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookies[0])
+		rw = httptest.NewRecorder()
+		handleRequest(rw, req)
+		assert.Equal(first, rw.Body.String())
+		assert.Empty(rw.Result().Cookies())
+	}
+
+	// Draining the pinned server moves the client to another one.
+	h := adminHandler()
+	drain := httptest.NewRecorder()
+	h.ServeHTTP(drain, httptest.NewRequest("POST", "/servers/drain?host="+first, nil))
+	assert.Equal(http.StatusNoContent, drain.Code)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	rw = httptest.NewRecorder()
+	handleRequest(rw, req)
+	assert.NotEqual(first, rw.Body.String())
+	assert.Len(rw.Result().Cookies(), 1)
+	assert.NotEqual(cookies[0].Value, rw.Result().Cookies()[0].Value)
+}
+
+func TestAffinityCookieSigned(t *testing.T) {
+	assert := assert.New(t)
+
+	servers := parseHosts("server1:8080,server2:8080")
+	a := newAffinity("lb-affinity", "secret")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "lb-affinity", Value: a.id(servers[1])})
+	assert.Equal(servers[1], a.pinned(req, servers))
+
+	forged := newAffinity("lb-affinity", "guess")
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "lb-affinity", Value: forged.id(servers[1])})
+	assert.Nil(a.pinned(req, servers))
+
+	assert.Nil(newAffinity("", "secret"))
+}
+
+func TestAffinityKeepsCanarySide(t *testing.T) {
+	assert := assert.New(t)
+
+	stable := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("stable"))
+	}))
+	defer stable.Close()
+	canaryBackend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("canary"))
+	}))
+	defer canaryBackend.Close()
+
+	defer func(old, oldCanary []*server, oldStickiness *affinity, oldSplit canaryConfig) {
+		serversPool, canaryPool, stickiness = old, oldCanary, oldStickiness
+		canary.set(oldSplit)
+	}(serversPool, canaryPool, stickiness, canary.current().Config)
+	serversPool = parseHosts(backendHost(stable))
+	canaryPool = parseHosts(backendHost(canaryBackend))
+	stickiness = newAffinity("lb-affinity", "secret")
+	canary.set(canaryConfig{Percent: 50})
+
+	for _, pool := range [][]*server{serversPool, canaryPool} {
+		want := "stable"
+		if pool[0] == canaryPool[0] {
+			want = "canary"
+		}
+		for i := 0; i < 10; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.AddCookie(&http.Cookie{Name: "lb-affinity", Value: stickiness.id(pool[0])})
+			rw := httptest.NewRecorder()
+			handleRequest(rw, req)
+			assert.Equal(want, rw.Body.String())
+			assert.Empty(rw.Result().Cookies())
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	// authSubjectHeader tells servers who the balancer let in: the API key
+	// name, the basic auth user or the sub claim of a JWT.
+	authSubjectHeader = "X-Auth-Subject"
+
+	// jwtLeeway allows for clock skew between the balancer and the issuer.
+	jwtLeeway = time.Minute
+
+	apr1Prefix = "$apr1$"
+	sha1Prefix = "{SHA}"
+)
+
+var (
+	errNoCredentials  = errors.New("missing credentials")
+	errBadCredentials = errors.New("invalid credentials")
+
+	authRejected = expvar.NewInt("lb_auth_rejected_total")
+)
+
+// authConfig lists the credentials a route accepts, any one of them lets
+// a request through.
+type authConfig struct {
+	// APIKeys maps key names to keys clients send in the X-API-Key header.
+	APIKeys map[string]string `json:"apiKeys,omitempty"`
+	// Htpasswd is a file of user:hash lines for basic auth, made with
+	// htpasswd -s (SHA-1) or -m (MD5).
+	Htpasswd string `json:"htpasswd,omitempty"`
+	// Realm is sent in challenges, "lb" by default.
+	Realm string     `json:"realm,omitempty"`
+	JWT   *jwtConfig `json:"jwt,omitempty"`
+
+	users map[string]string
+}
+
+type jwtConfig struct {
+	// Secret verifies HS256 tokens.
+	Secret string `json:"secret,omitempty"`
+	// PublicKey is a PEM file with the RSA key verifying RS256 tokens.
+	PublicKey string `json:"publicKey,omitempty"`
+	// JWKS is a local JSON Web Key Set file with RS256 keys picked by kid.
+	JWKS     string `json:"jwks,omitempty"`
+	Issuer   string `json:"issuer,omitempty"`
+	Audience string `json:"audience,omitempty"`
+	// Claims maps claim names to the headers servers get them in.
+	Claims map[string]string `json:"claims,omitempty"`
+
+	keys map[string]*rsa.PublicKey
+}
+
+func (ac *authConfig) validate() error {
+	if len(ac.APIKeys) == 0 && ac.Htpasswd == "" && ac.JWT == nil {
+		return errors.New("auth accepts no credentials")
+	}
+	for name, key := range ac.APIKeys {
+		if key == "" {
+			return fmt.Errorf("API key %s is empty", name)
+		}
+	}
+	if jc := ac.JWT; jc != nil && jc.Secret == "" && jc.PublicKey == "" && jc.JWKS == "" {
+		return errors.New("jwt needs a secret, publicKey or jwks")
+	}
+	return nil
+}
+
+// load reads the files auth refers to, relative paths are resolved
+// against dir.
+func (ac *authConfig) load(dir string) error {
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	if ac.Htpasswd != "" {
+		users, err := loadHtpasswd(resolve(ac.Htpasswd))
+		if err != nil {
+			return err
+		}
+		ac.users = users
+	}
+	if jc := ac.JWT; jc != nil {
+		jc.keys = make(map[string]*rsa.PublicKey)
+		if jc.PublicKey != "" {
+			key, err := loadRSAPublicKey(resolve(jc.PublicKey))
+			if err != nil {
+				return err
+			}
+			jc.keys[""] = key
+		}
+		if jc.JWKS != "" {
+			if err := jc.loadJWKS(resolve(jc.JWKS)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// authenticate checks the credentials of r and replaces the headers
+// servers trust with what they prove.
+func (ac *authConfig) authenticate(r *http.Request) error {
+	r.Header.Del(authSubjectHeader)
+	if ac.JWT != nil {
+		for _, header := range ac.JWT.Claims {
+			r.Header.Del(header)
+		}
+	}
+
+	var subject string
+	err := errNoCredentials
+	if auth := r.Header.Get("Authorization"); ac.JWT != nil && strings.HasPrefix(auth, "Bearer ") {
+		var claims map[string]interface{}
+		if claims, err = ac.JWT.verify(strings.TrimPrefix(auth, "Bearer "), time.Now()); err == nil {
+			subject = claimString(claims["sub"])
+			for claim, header := range ac.JWT.Claims {
+				if v, ok := claims[claim]; ok {
+					r.Header.Set(header, claimString(v))
+				}
+			}
+		}
+	} else if user, password, ok := r.BasicAuth(); ok && ac.users != nil {
+		if err = checkPassword(ac.users[user], password); err == nil {
+			subject = user
+		}
+	} else if key := r.Header.Get(apiKeyHeader); key != "" && len(ac.APIKeys) > 0 {
+		err = errBadCredentials
+		for name, want := range ac.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1 {
+				subject, err = name, nil
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if subject != "" {
+		r.Header.Set(authSubjectHeader, subject)
+	}
+	return nil
+}
+
+// writeUnauthorized answers a request whose credentials did not pass,
+// challenging the client with every scheme the route accepts.
+func writeUnauthorized(rw http.ResponseWriter, r *http.Request, info *requestInfo, err error) {
+	authRejected.Add(1)
+	if isGRPC(r) {
+		writeGRPCError(rw, grpcUnauthenticated, err.Error())
+		return
+	}
+	ac := info.route.Auth
+	realm := ac.Realm
+	if realm == "" {
+		realm = "lb"
+	}
+	if ac.users != nil {
+		rw.Header().Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+	}
+	if ac.JWT != nil {
+		challenge := fmt.Sprintf("Bearer realm=%q", realm)
+		if err != errNoCredentials {
+			challenge += `, error="invalid_token"`
+		}
+		rw.Header().Add("WWW-Authenticate", challenge)
+	}
+	writeProblem(rw, r, info, http.StatusUnauthorized, fmt.Sprintf("The request has %s.", err))
+}
+
+func loadHtpasswd(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected user:hash", path, line)
+		}
+		// Other crypt formats look like plain text passwords, never take
+		// a hash for one.
+		if !strings.HasPrefix(parts[1], sha1Prefix) && !strings.HasPrefix(parts[1], apr1Prefix) {
+			return nil, fmt.Errorf("%s:%d: unsupported hash, use htpasswd -s or -m", path, line)
+		}
+		users[parts[0]] = parts[1]
+	}
+	return users, nil
+}
+
+func checkPassword(hash, password string) error {
+	var got string
+	switch {
+	case hash == "":
+		// Unknown users take as long as known ones.
+		apr1(password, "unknown")
+		return errBadCredentials
+	case strings.HasPrefix(hash, sha1Prefix):
+		sum := sha1.Sum([]byte(password))
+		got = sha1Prefix + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, apr1Prefix):
+		salt := strings.SplitN(strings.TrimPrefix(hash, apr1Prefix), "$", 2)[0]
+		got = apr1(password, salt)
+	default:
+		return errBadCredentials
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(hash)) != 1 {
+		return errBadCredentials
+	}
+	return nil
+}
+
+// apr1 is the MD5 based crypt of Apache htpasswd -m.
+func apr1(password, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+	alt := md5.Sum([]byte(password + salt + password))
+	h := md5.New()
+	h.Write([]byte(password + apr1Prefix + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out strings.Builder
+	encode := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	encode(uint(final[11]), 2)
+	return apr1Prefix + salt + "$" + out.String()
+}
+
+// verify checks the signature and time limits of a compact JWT and
+// returns its claims.
+func (jc *jwtConfig) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errBadCredentials
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errBadCredentials
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errBadCredentials
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if jc.Secret == "" {
+			return nil, errBadCredentials
+		}
+		mac := hmac.New(sha256.New, []byte(jc.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errBadCredentials
+		}
+	case "RS256":
+		if !jc.verifyRSA(header.Kid, signed, sig) {
+			return nil, errBadCredentials
+		}
+	default:
+		return nil, errBadCredentials
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errBadCredentials
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("expired token")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if jc.Issuer != "" && claims["iss"] != jc.Issuer {
+		return nil, errBadCredentials
+	}
+	if jc.Audience != "" && !hasAudience(claims["aud"], jc.Audience) {
+		return nil, errBadCredentials
+	}
+	return claims, nil
+}
+
+func (jc *jwtConfig) verifyRSA(kid string, signed, sig []byte) bool {
+	digest := sha256.Sum256(signed)
+	if key, ok := jc.keys[kid]; ok {
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	// Keys without an id, like the PEM one, are tried in turn.
+	for _, key := range jc.keys {
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func hasAudience(aud interface{}, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []interface{}:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString renders a claim for a header: strings as they are, lists
+// of strings comma-separated and anything else as JSON.
+func claimString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		var res []string
+		for _, item := range v {
+			res = append(res, claimString(item))
+		}
+		return strings.Join(res, ",")
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+func (jc *jwtConfig) loadJWKS(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(f).Decode(&set); err != nil {
+		return fmt.Errorf("parsing %s: %s", path, err)
+	}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("%s: key %s: %s", path, k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("%s: key %s: %s", path, k.Kid, err)
+		}
+		jc.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(jc.keys) == 0 {
+		return fmt.Errorf("%s: no RSA keys", path)
+	}
+	return nil
+}
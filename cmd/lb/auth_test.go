@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func signJWT(t *testing.T, header, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret string) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	assert := assert.New(t)
+
+	// Hashes made with openssl passwd -apr1 and htpasswd -s.
+	assert.Nil(checkPassword("$apr1$xyzsalt$2kqqXzYgVpbpz.SGmIK7J0", "secret"))
+	assert.Nil(checkPassword("$apr1$ab$3TJnYXtd8SDUS33AJjdhC0", "a much longer password here!"))
+	assert.Nil(checkPassword("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret"))
+	assert.Equal(errBadCredentials, checkPassword("secret", "secret"))
+	assert.Equal(errBadCredentials, checkPassword("$6$salt$hash", "$6$salt$hash"))
+	assert.Equal(errBadCredentials, checkPassword("$apr1$xyzsalt$2kqqXzYgVpbpz.SGmIK7J0", "Secret"))
+	assert.Equal(errBadCredentials, checkPassword("{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "secret "))
+	assert.Equal(errBadCredentials, checkPassword("", ""))
+}
+
+func TestJWTVerify(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&other.PublicKey)
+	pemPath := filepath.Join(dir, "key.pem")
+	_ = ioutil.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "k1",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	_ = ioutil.WriteFile(filepath.Join(dir, "jwks.json"), jwks, 0o600)
+
+	ac := &authConfig{JWT: &jwtConfig{Secret: "s3cret", PublicKey: "key.pem", JWKS: "jwks.json", Issuer: "idp", Audience: "lb"}}
+	assert.Nil(ac.validate())
+	assert.Nil(ac.load(dir))
+	jc := ac.JWT
+
+	now := time.Now()
+	claims := map[string]interface{}{"sub": "alice", "iss": "idp", "aud": []string{"other", "lb"}, "exp": now.Add(time.Hour).Unix()}
+	for name, token := range map[string]string{
+		"hs256":       signJWT(t, map[string]interface{}{"alg": "HS256"}, claims, hs256("s3cret")),
+		"jwks by kid": signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, rs256(t, key)),
+		"pem":         signJWT(t, map[string]interface{}{"alg": "RS256"}, claims, rs256(t, other)),
+	} {
+		got, err := jc.verify(token, now)
+		if assert.Nil(err, name) {
+			assert.Equal("alice", got["sub"])
+		}
+	}
+
+	for name, token := range map[string]string{
+		"wrong secret": signJWT(t, map[string]interface{}{"alg": "HS256"}, claims, hs256("guess")),
+		"unknown key":  signJWT(t, map[string]interface{}{"alg": "RS256", "kid": "k1"}, claims, rs256(t, other)),
+		"alg none":     signJWT(t, map[string]interface{}{"alg": "none"}, claims, func([]byte) []byte { return nil }),
+		"garbage":      "not.a.token",
+	} {
+		_, err := jc.verify(token, now)
+		assert.NotNil(err, name)
+	}
+
+	token := signJWT(t, map[string]interface{}{"alg": "HS256"}, claims, hs256("s3cret"))
+	_, err = jc.verify(token, now.Add(2*time.Hour))
+	assert.NotNil(err, "expired")
+	jc.Audience = "billing"
+	_, err = jc.verify(token, now)
+	assert.NotNil(err, "audience")
+
+	assert.NotNil((&authConfig{}).validate())
+	assert.NotNil((&authConfig{JWT: &jwtConfig{}}).validate())
+	_, err = loadHtpasswd(filepath.Join(dir, "missing"))
+	assert.NotNil(err)
+	for _, hash := range []string{"secret", "$2y$05$abcdefghijklmnopqrstuv", "$5$salt$hash", "$6$salt$hash", "abJnggxhB/yJU"} {
+		_ = ioutil.WriteFile(filepath.Join(dir, "users"), []byte("bob:"+hash+"\n"), 0o600)
+		_, err = loadHtpasswd(filepath.Join(dir, "users"))
+		assert.NotNil(err, hash)
+	}
+}
+
+func TestRouteAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_ = ioutil.WriteFile(filepath.Join(dir, "users"), []byte("# team\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Seen-Subject", r.Header.Get(authSubjectHeader))
+		rw.Header().Set("Seen-Roles", r.Header.Get("X-Roles"))
+	}))
+	defer backend.Close()
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(backend))
+
+	rc := routeConfig{Prefix: "/api/", Auth: &authConfig{
+		APIKeys:  map[string]string{"ci": "key-123"},
+		Htpasswd: "users",
+		JWT:      &jwtConfig{Secret: "s3cret", Claims: map[string]string{"roles": "X-Roles"}},
+	}}
+	assert.Nil(rc.validate())
+	assert.Nil(rc.load(dir))
+	routes.set([]routeConfig{rc})
+	defer routes.set(nil)
+
+	send := func(prepare func(r *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+		req.Header.Set(authSubjectHeader, "spoofed")
+		prepare(req)
+		rw := httptest.NewRecorder()
+		handleRequest(rw, req)
+		return rw
+	}
+
+	rw := send(func(*http.Request) {})
+	assert.Equal(http.StatusUnauthorized, rw.Code)
+	assert.Equal(problemContentType, rw.Header().Get("Content-Type"))
+	assert.Equal([]string{`Basic realm="lb"`, `Bearer realm="lb"`}, rw.Header().Values("WWW-Authenticate"))
+
+	rw = send(func(r *http.Request) { r.Header.Set(apiKeyHeader, "wrong") })
+	assert.Equal(http.StatusUnauthorized, rw.Code)
+	rw = send(func(r *http.Request) { r.Header.Set(apiKeyHeader, "key-123") })
+	assert.Equal(http.StatusOK, rw.Code)
+	assert.Equal("ci", rw.Header().Get("Seen-Subject"))
+
+	rw = send(func(r *http.Request) { r.SetBasicAuth("bob", "secret") })
+	assert.Equal(http.StatusOK, rw.Code)
+	assert.Equal("bob", rw.Header().Get("Seen-Subject"))
+	rw = send(func(r *http.Request) { r.SetBasicAuth("eve", "secret") })
+	assert.Equal(http.StatusUnauthorized, rw.Code)
+
+	token := signJWT(t, map[string]interface{}{"alg": "HS256"}, map[string]interface{}{"sub": "carol", "roles": []string{"admin", "dev"}}, hs256("s3cret"))
+	rw = send(func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+		r.Header.Set("X-Roles", "root")
+	})
+	assert.Equal(http.StatusOK, rw.Code)
+	assert.Equal("carol", rw.Header().Get("Seen-Subject"))
+	assert.Equal("admin,dev", rw.Header().Get("Seen-Roles"))
+	rw = send(func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token+"x") })
+	assert.Equal(http.StatusUnauthorized, rw.Code)
+	assert.Contains(rw.Header().Values("WWW-Authenticate"), `Bearer realm="lb", error="invalid_token"`)
+
+	// Other routes stay open but do not pass identity headers on.
+	req := httptest.NewRequest("GET", "/public", nil)
+	req.Header.Set(authSubjectHeader, "spoofed")
+	req.Header.Set("X-Roles", "root")
+	rw = httptest.NewRecorder()
+	handleRequest(rw, req)
+	assert.Equal(http.StatusOK, rw.Code)
+	assert.Empty(rw.Header().Get("Seen-Subject"))
+	assert.Empty(rw.Header().Get("Seen-Roles"))
+}
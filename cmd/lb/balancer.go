@@ -2,29 +2,115 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
 	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
 	"github.com/pavlovskyive/kpi-lab-2-balancer/signal"
+	"github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 var (
 	port       = flag.Int("port", 8090, "load balancer port")
+	listen     = flag.String("listen", "", "comma-separated addresses to listen on instead of -port: host:port, [ipv6]:port, unix:/path or fd:N")
 	timeoutSec = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https      = flag.Bool("https", false, "whether backends support HTTPs")
 
+	tlsCert    = flag.String("tls-cert", "", "certificate file to serve HTTPS and HTTP/2 with")
+	tlsKey     = flag.String("tls-key", "", "private key file for -tls-cert")
+	h2cEnabled = flag.Bool("h2c", false, "whether to accept cleartext HTTP/2, e.g. for gRPC")
+
+	proxyProtocolFrom     = flag.String("proxy-protocol-from", "", "comma-separated addresses or CIDRs of load balancers whose connections start with a PROXY protocol header")
+	proxyProtocolUpstream = flag.String("proxy-protocol-upstream", "", "PROXY protocol version, v1 or v2, to send to servers in tcp mode, disabled if empty")
+
+	mode           = flag.String("mode", modeHTTP, "proxy mode: http or tcp")
+	strategyName   = flag.String("strategy", "", "balancing strategy: least-traffic or least-conn, defaults to least-conn in tcp mode")
+	tcpIdleTimeout = flag.Duration("tcp-idle-timeout", 5*time.Minute, "close proxied TCP connections idle for this long")
+
+	compression     = flag.Bool("compress", false, "gzip or deflate responses for clients that accept it")
+	compressTypes   = flag.String("compress-types", "application/json,application/javascript,application/xml,image/svg+xml,text/*", "comma-separated content types to compress, type/* matches every subtype but text/event-stream")
+	compressMinSize = flag.Int("compress-min-size", 1024, "smallest response body in bytes worth compressing")
+
+	dialTimeout           = flag.Duration("dial-timeout", 0, "timeout for connecting to a server")
+	tlsHandshakeTimeout   = flag.Duration("tls-handshake-timeout", 0, "timeout for the TLS handshake with a server")
+	responseHeaderTimeout = flag.Duration("response-header-timeout", 0, "timeout for response headers after the request is sent")
+	idleBodyTimeout       = flag.Duration("idle-body-timeout", 0, "maximum pause while reading a response body")
+
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	traceExport  = flag.String("trace-export", "", "file path or OTLP/HTTP collector URL to export spans to")
+	retries      = flag.Int("retries", 0, "how many times to retry an idempotent request on another server")
+
+	adminPort    = flag.Int("admin-port", 0, "port for the admin API and metrics, disabled if 0")
+	maxInFlight  = flag.Int("max-in-flight", 0, "maximum concurrent requests per server, unlimited if 0")
+	queueSize    = flag.Int("queue-size", 100, "maximum number of requests waiting for a free server")
+	queueTimeout = flag.Duration("queue-timeout", time.Second, "maximum time a request waits for a free server")
+
+	adaptiveLimit     = flag.Int("adaptive-limit", 0, "learn per-server concurrency limits of up to this many requests from latency, disabled if 0")
+	adaptiveTolerance = flag.Float64("adaptive-tolerance", 2, "how many times slower than the fastest recent response a response may be before limits go down")
+	priorityHeader    = flag.String("priority-header", "X-Priority", "request header that marks low-priority requests with the value low")
+
+	affinityCookie = flag.String("affinity-cookie", "", "name of the cookie pinning clients to servers, disabled if empty")
+	affinitySecret = flag.String("affinity-secret", "", "key to sign affinity cookies with, random if empty")
+
+	gossipListen = flag.String("gossip-listen", "", "UDP address to exchange health observations with peers on, disabled if empty")
+	gossipPeers  = flag.String("gossip-peers", "", "comma-separated UDP addresses of peer balancers")
+	gossipKey    = flag.String("gossip-key", "", "key shared by peer balancers to sign gossip messages with, required with -gossip-listen")
+	nodeName     = flag.String("node-name", "", "name of this balancer among its peers, defaults to the hostname")
+
+	zone           = flag.String("zone", "", "zone of this balancer, servers in the same zone get requests first; disabled if empty")
+	zoneMinHealthy = flag.Float64("zone-min-healthy", 0.5, "share of servers in the local zone that must be healthy to keep every request in it")
+	zoneSpillover  = flag.Float64("zone-spillover", 0.5, "share of requests sent to other zones while the local one is short of healthy servers")
+
+	stateDir      = flag.String("state-dir", "", "datastore directory to checkpoint server state to and restore it from, disabled if empty")
+	stateInterval = flag.Duration("state-interval", 30*time.Second, "how often to checkpoint server state")
+
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "how long the old process finishes in-flight requests after handing its sockets to a new one on SIGUSR2")
+
+	configPath    = flag.String("config", "", "JSON config file, reloaded on SIGHUP")
+	checkOnly     = flag.Bool("check-config", false, "check flags and the config file, print a report and exit, non-zero on errors")
+	checkProbe    = flag.Bool("check-probe", false, "with -check-config, also run one health check against every server")
+	canaryServers = flag.String("canary-servers", "", "comma-separated canary pool")
+	shadowServers = flag.String("shadow-servers", "", "comma-separated shadow pool to mirror traffic to")
+	shadowPercent = flag.Float64("shadow-percent", 0, "percentage of requests to mirror to the shadow pool")
+	shadowLimit   = flag.Int("shadow-max-in-flight", 64, "maximum number of requests mirrored at once, more are not mirrored")
+
+	accessLogPath   = flag.String("access-log", "", "access log file path, stdout if empty")
+	accessLogFormat = flag.String("access-log-format", logFormatJSON, "access log format: json, common or combined")
+	accessLogSample = flag.Float64("access-log-sample", 1, "fraction of successful requests to write to the access log")
+)
+
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
+var (
+	tracer         = tracing.NewTracer("lb", nil)
+	accessLog      *accessLogger
+	backendLimiter = newLimiter(0, 0, 0)
+	stickiness     *affinity
+	cluster        *gossiper
 )
 
 var (
-	timeout     = time.Duration(*timeoutSec) * time.Second
-	serversPool = []*server{
+	timeout         = time.Duration(*timeoutSec) * time.Second
+	defaultTimeouts = timeoutConfig{Total: duration(timeout)}
+	healthInterval  = 10 * time.Second
+	serversPool     = []*server{
 		{
 			host:      "server1:8080",
 			isHealthy: true,
@@ -44,6 +130,23 @@ type server struct {
 	host      string
 	isHealthy bool
 	traffic   int
+	inFlight  int
+	draining  bool
+	pool      *pool
+	// tier orders servers of a pool by priority, the lower the sooner they
+	// get requests.
+	tier int
+	zone string
+
+	// checkedAt and failures keep the health history: when the server was
+	// last checked and how many checks in a row it has failed since.
+	checkedAt time.Time
+	failures  int
+}
+
+// available reports whether the server may take new requests.
+func (s *server) available() bool {
+	return s.isHealthy && !s.draining
 }
 
 func scheme() string {
@@ -53,65 +156,276 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+func health(dst *server) bool {
+	span := tracer.Start("health-check", tracing.KindClient, tracing.SpanContext{})
+	span.SetAttribute("server.address", dst.host)
+	defer span.Finish()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+		fmt.Sprintf("%s://%s/health", scheme(), dst.urlHost()), nil)
+	tracing.Inject(req.Header, span.Context)
+	resp, err := poolOf(dst).client.Do(req)
 	if err != nil {
+		span.SetError(err.Error())
 		return false
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
+		span.SetError(resp.Status)
 		return false
 	}
+	span.SetOk()
 	return true
 }
 
-func forward(dst *server, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
+func forward(dst *server, rw http.ResponseWriter, r *http.Request, info *requestInfo) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	timer := &phaseTimer{cancel: cancel}
+	defer timer.stop()
+	grpc := isGRPC(r)
+	// A gRPC deadline covers the whole call, streamed messages included,
+	// Total only the wait for the response headers.
+	total := &phaseTimer{cancel: cancel}
+	defer total.stop()
+	callTimeout, hasDeadline := grpcTimeout(r)
+	hasDeadline = grpc && hasDeadline
+	if hasDeadline {
+		total.start("grpc call", callTimeout)
+	} else {
+		total.start("request", info.timeouts.Total)
+	}
+	upstream := poolOf(dst)
+	fwdRequest := r.Clone(upstream.trace(timer.trace(withTimeouts(ctx, info.timeouts), info.timeouts)))
 	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst.host
+	fwdRequest.URL.Host = dst.urlHost()
 	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst.host
+	fwdRequest.Host = dst.hostHeader()
+	var rewrite *rewriteConfig
+	if info.route != nil {
+		rewrite = info.route.Rewrite
+	}
+	if rewrite != nil {
+		rewrite.rewriteRequest(fwdRequest)
+	}
+
+	info.backend = dst.host
+	info.attempts++
+	span := tracer.Start("forward", tracing.KindClient, info.span.Context)
+	span.SetAttribute("server.address", dst.host)
+	span.SetAttribute("lb.attempt", strconv.Itoa(info.attempts))
+	defer span.Finish()
+	tracing.Inject(fwdRequest.Header, span.Context)
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	upstreamStart := time.Now()
+	resp, err := upstream.client.Do(fwdRequest)
+	timer.stop()
+	if !hasDeadline {
+		total.stop()
+	}
+	info.upstreamLatency += time.Since(upstreamStart)
+	err = timer.wrap(ctx, total.wrap(ctx, err))
 	if err == nil {
+		span.SetAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+		defer resp.Body.Close()
+		if grpc && resp.StatusCode != http.StatusOK && resp.Header.Get("grpc-status") == "" {
+			writeGRPCError(rw, grpcCodeFromHTTP(resp.StatusCode), resp.Status)
+			return nil
+		}
 		for k, values := range resp.Header {
+			if k == "Trailer" || k == http.CanonicalHeaderKey(httptools.RequestIDHeader) {
+				continue
+			}
 			for _, value := range values {
 				rw.Header().Add(k, value)
 			}
 		}
+		if rewrite != nil {
+			rewrite.Response.apply(rw.Header())
+		}
 		if *traceEnabled {
 			rw.Header().Set("lb-from", dst.host)
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL, "bytes:", resp.ContentLength)
-		dst.traffic += int(resp.ContentLength)
+		backendLimiter.addTraffic(dst, int(resp.ContentLength))
 		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
+		body := &idleReader{ReadCloser: resp.Body, timer: timer, idle: info.timeouts.IdleBody}
+		switch {
+		case grpc || isEventStream(resp):
+			_, err = copyFlushing(rw, body)
+		case resp.ContentLength < 0:
+			_, err = copyFlushingEvery(rw, body, streamFlushInterval)
+		default:
+			_, err = io.Copy(rw, body)
+		}
 		if err != nil {
+			err = timer.wrap(ctx, total.wrap(ctx, err))
 			log.Printf("Failed to write response: %s", err)
+			span.SetError(err.Error())
+			if grpc {
+				setGRPCFailure(rw, err)
+				return nil
+			}
+			return &abortError{err: err}
 		}
+		copyTrailers(rw, resp)
 		return nil
 	} else {
 		log.Printf("Failed to get response from %s: %s", dst.host, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
+		span.SetError(err.Error())
 		return err
 	}
 }
 
-func balance(servers []*server) (*server, error) {
-	var healthyServers []*server
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+func handleRequest(rw http.ResponseWriter, r *http.Request) {
+	parent, _ := tracing.Extract(r.Header)
+	info := &requestInfo{
+		id:    requestID(r),
+		start: time.Now(),
+		span:  tracer.Start("lb", tracing.KindServer, parent),
+	}
+	info.span.SetAttribute("http.method", r.Method)
+	info.span.SetAttribute("http.target", r.URL.RequestURI())
+	info.span.SetAttribute("http.request_id", info.id)
+	info.route = routes.match(r.URL.Path)
+	info.timeouts = defaultTimeouts.merge(info.route.Timeouts)
+	r.Header.Set(httptools.RequestIDHeader, info.id)
+	rw.Header().Set(httptools.RequestIDHeader, info.id)
+	// sent counts the bytes that reach the client, compressed or not.
+	sent := &statusRecorder{ResponseWriter: rw}
+	rw = sent
+	var cw *compressWriter
+	if *compression && r.Method != http.MethodHead && !isGRPC(r) {
+		cw = newCompressWriter(rw, r, *compressMinSize)
+		rw = cw
+	}
+	rec := &statusRecorder{ResponseWriter: rw}
+	defer func() {
+		info.span.SetAttribute("http.status_code", strconv.Itoa(rec.status))
+		info.span.Finish()
+		accessLog.log(newAccessEntry(r, info, rec.status, sent.bytes))
+	}()
+	if cw != nil {
+		defer cw.close()
+	}
+	if scope, ok := access.check(r, info.route); !ok {
+		accessDenied.Add(scope, 1)
+		info.span.SetError("client address not allowed")
+		writeForbidden(rec, r, info)
+		return
+	}
+	routes.stripIdentity(r)
+	if info.route.Auth != nil {
+		if err := info.route.Auth.authenticate(r); err != nil {
+			info.span.SetError(err.Error())
+			writeUnauthorized(rec, r, info, err)
+			return
+		}
+	}
+
+	var out http.ResponseWriter = rec
+	if shouldMirror(r, *shadowPercent) {
+		if primary := startMirror(r, info, *shadowLimit); primary != nil {
+			mirrorRec := &mirrorRecorder{statusRecorder: rec, hash: sha1.New()}
+			out = mirrorRec
+			defer func() {
+				primary <- mirrorRec.result()
+			}()
+		}
+	}
 
+	candidates := serversPool
+	if info.route.Pool != "" && info.route.Pool != stablePoolName {
+		candidates = poolServers(info.route.Pool)
+	} else if len(canaryPool) > 0 && canary.choose(r, stickiness.pinnedPool(r)) {
+		candidates = canaryPool
+		defer func() {
+			canary.record(rec.status >= http.StatusInternalServerError)
+		}()
+	}
+	ctx := r.Context()
+	if lowPriority(r, info.route) {
+		ctx = withLowPriority(ctx)
+	}
+	pinned := stickiness.pinned(r, candidates)
+	for {
+		// TODO: Рееалізуйте свій алгоритм балансувальника.
+		var optimalServer *server
+		var err error
+		if pinned != nil && backendLimiter.keepsPin(pinned, candidates) {
+			optimalServer, err = backendLimiter.acquire(ctx, []*server{pinned})
+		} else {
+			optimalServer, err = backendLimiter.acquire(ctx, candidates)
+		}
+
+		if err != nil {
+			log.Printf("No server for %s: %s", info.id, err)
+			info.span.SetError(err.Error())
+			if isOverload(err) {
+				rec.Header().Set("Retry-After", retryAfter(backendLimiter.queueTimeout))
+			}
+			writeFailure(rec, r, info, err)
+			return
+		}
+
+		if stickiness != nil && optimalServer != pinned {
+			stickiness.pin(out, r, optimalServer)
+		}
+		upstreamLatency := info.upstreamLatency
+		err = forward(optimalServer, out, r, info)
+		backendLimiter.observe(optimalServer, info.upstreamLatency-upstreamLatency, err)
+		backendLimiter.release(optimalServer)
+		if err == nil {
+			return
+		}
+		var aborted *abortError
+		if errors.As(err, &aborted) {
+			info.span.SetError(err.Error())
+			// The client must not take a cut off body for a whole one.
+			panic(http.ErrAbortHandler)
+		}
+		if info.attempts > *retries || !isIdempotent(r) || r.Context().Err() != nil {
+			info.span.SetError(err.Error())
+			writeFailure(rec, r, info, err)
+			return
+		}
+		candidates = without(candidates, optimalServer)
+		pinned = nil
+	}
+}
+
+func retryAfter(d time.Duration) string {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+func without(servers []*server, excluded *server) []*server {
+	var res []*server
 	for _, server := range servers {
-		if server.isHealthy {
-			healthyServers = append(healthyServers, server)
+		if server != excluded {
+			res = append(res, server)
 		}
 	}
+	return res
+}
+
+func balance(servers []*server) (*server, error) {
+	healthyServers := healthy(servers)
 
 	if len(healthyServers) == 0 {
-		return nil, errors.New("no healthy servers at moment")
+		return nil, errNoHealthyServers
 	}
 
 	optimalServer := healthyServers[0]
@@ -126,43 +440,292 @@ func balance(servers []*server) (*server, error) {
 
 }
 
-func main() {
-	flag.Parse()
+func checkHealth(s *server) bool {
+	switch poolOf(s).healthCheck {
+	case healthCheckHTTP:
+		return health(s)
+	case healthCheckTCP:
+		return tcpHealth(s)
+	case healthCheckGRPC:
+		return grpcHealth(s)
+	}
+	if *mode == modeTCP {
+		return tcpHealth(s)
+	}
+	return health(s)
+}
 
-	// TODO: Використовуйте дані про стан сервреа, щоб підтримувати список тих серверів, яким можна відправляти ззапит.
-	for _, server := range serversPool {
+// setHealthy updates the server under the lock the balancing strategies
+// read it with and returns its traffic.
+func setHealthy(s *server, healthy bool) int {
+	backendLimiter.mux.Lock()
+	defer backendLimiter.mux.Unlock()
+	s.isHealthy = healthy
+	s.checkedAt = time.Now()
+	if healthy {
+		s.failures = 0
+	} else {
+		s.failures++
+	}
+	return s.traffic
+}
+
+func monitorHealth(servers []*server) {
+	for _, server := range servers {
 		server := server
 		go func() {
-			for range time.Tick(10 * time.Second) {
-				server.isHealthy = health(server.host)
+			// Spread probes so that peers sharing observations take turns.
+			time.Sleep(time.Duration(rand.Int63n(int64(healthInterval))))
+			for range time.Tick(healthInterval) {
+				var isHealthy bool
+				if obs, ok := cluster.fresh(server.host, healthInterval); ok {
+					healthProbesSkipped.Add(1)
+					isHealthy = obs.Healthy
+				} else {
+					healthProbes.Add(1)
+					isHealthy = checkHealth(server)
+					cluster.observe(server.host, isHealthy)
+				}
+				traffic := setHealthy(server, isHealthy)
 
 				serverStatus := ""
-				if server.isHealthy {
+				if isHealthy {
 					serverStatus = "healthy"
 				} else {
 					serverStatus = "down"
 				}
 
-				log.Println("server:", server.host, "status:", serverStatus, "traffic:", server.traffic)
+				log.Println("server:", server.host, "status:", serverStatus, "traffic:", traffic)
 			}
 		}()
 	}
+}
+
+func main() {
+	// "lb validate [flags]" is the same as "lb -check-config [flags]".
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		_ = flag.CommandLine.Parse(os.Args[2:])
+		*checkOnly = true
+	} else {
+		flag.Parse()
+	}
+	timeout = time.Duration(*timeoutSec) * time.Second
+	defaultTimeouts = timeoutConfig{
+		Dial:           duration(*dialTimeout),
+		TLSHandshake:   duration(*tlsHandshakeTimeout),
+		ResponseHeader: duration(*responseHeaderTimeout),
+		IdleBody:       duration(*idleBodyTimeout),
+		Total:          duration(timeout),
+	}
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		// TODO: Рееалізуйте свій алгоритм балансувальника.
-		optimalServer, err := balance(serversPool)
+	if *checkOnly {
+		if checkConfig(os.Stdout, *checkProbe) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
 
-		if err != nil {
-			log.Printf("503: no availible servers")
-			rw.WriteHeader(http.StatusServiceUnavailable)
-			return
+	// Health checks and gossip start below and trace their work.
+	exporter, err := tracing.NewExporter(*traceExport)
+	if err != nil {
+		log.Fatalf("Failed to set up span export: %s", err)
+	}
+	tracer = tracing.NewTracer("lb", exporter)
+
+	shadowPool = parseHosts(*shadowServers)
+	canaryPool = parseHosts(*canaryServers)
+	cfg := new(config)
+	if *configPath != "" {
+		if cfg, err = loadConfig(*configPath); err != nil {
+			log.Fatalf("Failed to load config: %s", err)
+		}
+	}
+	setupPools(cfg.Pools)
+	if *affinityCookie != "" && *affinitySecret == "" {
+		log.Println("No -affinity-secret given, affinity cookies will not survive a restart")
+	}
+	stickiness = newAffinity(*affinityCookie, *affinitySecret)
+	applyConfig(cfg)
+
+	*strategyName = strategyOrDefault(*strategyName, *mode)
+	if balanceStrategy, err = strategyByName(*strategyName); err != nil {
+		log.Fatal(err)
+	}
+	if *mode != modeHTTP && *mode != modeTCP {
+		log.Fatalf("unknown mode %q", *mode)
+	}
+	if *proxyProtocolUpstream != "" && *proxyProtocolUpstream != proxyProtocolV1 && *proxyProtocolUpstream != proxyProtocolV2 {
+		log.Fatalf("unknown PROXY protocol version %q", *proxyProtocolUpstream)
+	}
+
+	// Gossip, state restore and health checks update servers under the
+	// limiter's lock, it must be in place before they start.
+	if err := validateZoneFlags(); err != nil {
+		log.Fatal(err)
+	}
+	expvar.NewString("lb_zone").Set(*zone)
+	backendLimiter = newLimiter(*maxInFlight, *queueSize, *queueTimeout)
+	if *adaptiveLimit > 0 {
+		if *adaptiveTolerance < 1 {
+			log.Fatalf("-adaptive-tolerance must be at least 1, got %v", *adaptiveTolerance)
+		}
+		backendLimiter.enableAdaptive(*adaptiveLimit, *adaptiveTolerance)
+	}
+
+	if *gossipListen != "" {
+		if *nodeName == "" {
+			*nodeName, _ = os.Hostname()
+		}
+		if cluster, err = newGossiper(*nodeName, *gossipListen, *gossipKey, strings.Split(*gossipPeers, ",")); err != nil {
+			log.Fatalf("Failed to start gossip: %s", err)
+		}
+		cluster.start(healthInterval / 2)
+	}
+
+	var state *stateStore
+	if *stateDir != "" {
+		if state, err = openStateStore(*stateDir); err != nil {
+			log.Fatalf("Failed to open state store: %s", err)
 		}
+		log.Printf("Restored state of %d servers from %s", state.restore(allServers()), *stateDir)
+		go state.run(*stateInterval)
+	}
 
-		forward(optimalServer, rw, r)
+	// TODO: Використовуйте дані про стан сервреа, щоб підтримувати список тих серверів, яким можна відправляти ззапит.
+	monitorHealth(serversPool)
+	monitorHealth(shadowPool)
+	monitorHealth(canaryPool)
+	for _, p := range routedPools() {
+		monitorHealth(p.servers)
+	}
+
+	expvar.Publish("lb_adaptive_limits", expvar.Func(func() interface{} {
+		return backendLimiter.learnedLimits()
+	}))
+	expvar.NewString("lb_version").Set(version)
+	compressibleTypes = parseContentTypes(*compressTypes)
+	expvar.Publish("lb_in_flight", expvar.Func(func() interface{} {
+		return backendLimiter.inFlight()
 	}))
+	var servers []httptools.Server
+	if admin := startAdmin(*adminPort); admin != nil {
+		servers = append(servers, admin)
+	}
+
+	accessLog, err = newAccessLogger(*accessLogPath, *accessLogFormat, *accessLogSample)
+	if err != nil {
+		log.Fatalf("Failed to open access log: %s", err)
+	}
+	signal.OnHangup(func() {
+		if err := accessLog.reopen(); err != nil {
+			log.Printf("Failed to reopen access log: %s", err)
+		}
+		if *configPath == "" {
+			return
+		}
+		cfg, err := loadConfig(*configPath)
+		if err == nil {
+			err = cfg.checkReload()
+		}
+		if err != nil {
+			log.Printf("Failed to reload config, keeping the old one: %s", err)
+		} else {
+			applyConfig(cfg)
+			log.Printf("Reloaded config from %s", *configPath)
+		}
+	})
 
 	log.Println("Starting load balancer...")
-	log.Printf("Tracing support enabled: %t", *traceEnabled)
-	frontend.Start()
-	signal.WaitForTerminationSignal()
+	specs := []string{strconv.Itoa(*port)}
+	if *listen != "" {
+		specs = strings.Split(*listen, ",")
+	}
+	listeners, err := listenAll(specs)
+	if err != nil {
+		log.Fatalf("Failed to listen: %s", err)
+	}
+	// Socket files outlive the process for an upgraded one to keep serving on
+	// them, Listen removes them when they turn stale.
+	keepUnixSockets(listeners)
+	if trusted, err := parseCIDRs(*proxyProtocolFrom); err != nil {
+		log.Fatalf("Bad -proxy-protocol-from: %s", err)
+	} else if len(trusted) > 0 {
+		for i, l := range listeners {
+			listeners[i] = &proxyListener{Listener: l, trusted: trusted}
+		}
+	}
+	var tcpListeners []net.Listener
+	if *mode == modeTCP {
+		tcpListeners = listeners
+		for _, l := range listeners {
+			startTCP(l, *tcpIdleTimeout)
+		}
+	} else {
+		var handler http.Handler = http.HandlerFunc(handleRequest)
+		if *h2cEnabled {
+			handler = h2c.NewHandler(handler, new(http2.Server))
+		}
+		log.Printf("Tracing support enabled: %t", *traceEnabled)
+		frontend := httptools.CreateServerOn(listeners, handler, *tlsCert, *tlsKey)
+		frontend.Start()
+		servers = append(servers, frontend)
+	}
+
+	var upgradeMux sync.Mutex
+	upgraded := make(chan struct{})
+	signal.OnUpgrade(func() {
+		upgradeMux.Lock()
+		defer upgradeMux.Unlock()
+		select {
+		case <-upgraded:
+			return
+		default:
+		}
+		log.Println("Upgrading...")
+		// The new process restores the state store, it must not have two writers.
+		if state != nil {
+			if err := state.close(); err != nil {
+				log.Printf("Failed to save state: %s", err)
+			}
+		}
+		if err := upgrade(); err != nil {
+			log.Printf("Failed to upgrade, carrying on: %s", err)
+			if state != nil {
+				if state, err = openStateStore(*stateDir); err != nil {
+					log.Printf("Failed to reopen state store: %s", err)
+				} else {
+					go state.run(*stateInterval)
+				}
+			}
+			return
+		}
+		state = nil
+		close(upgraded)
+	})
+	stopped := make(chan struct{})
+	go func() {
+		signal.WaitForTerminationSignal()
+		close(stopped)
+	}()
+	notifyReady()
+
+	select {
+	case <-stopped:
+	case <-upgraded:
+		log.Printf("Draining for up to %s...", *drainTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		drain(ctx, servers, tcpListeners)
+		cancel()
+		if cluster != nil {
+			_ = cluster.close()
+		}
+	}
+	tracer.Flush()
+	upgradeMux.Lock()
+	defer upgradeMux.Unlock()
+	if state != nil {
+		if err := state.close(); err != nil {
+			log.Printf("Failed to save state: %s", err)
+		}
+	}
 }
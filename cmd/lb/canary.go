@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	canaryAlways = "always"
+	canaryNever  = "never"
+
+	canaryWindow = time.Minute
+)
+
+var (
+	canaryPool []*server
+	canary     = new(canarySplit)
+)
+
+type canaryConfig struct {
+	// Percent of requests without an explicit header or cookie
+	// preference that go to the canary pool.
+	Percent float64 `json:"percent"`
+	// Header and Cookie name a request value of "always" or "never"
+	// that overrides the percentage split.
+	Header string `json:"header,omitempty"`
+	Cookie string `json:"cookie,omitempty"`
+	// The split is rolled back when more than MaxErrorRate of canary
+	// requests fail within a minute, once MinRequests have been seen.
+	MaxErrorRate float64 `json:"maxErrorRate,omitempty"`
+	MinRequests  int     `json:"minRequests,omitempty"`
+}
+
+func (c canaryConfig) validate() error {
+	if c.Percent < 0 || c.Percent > 100 {
+		return fmt.Errorf("canary percent must be within [0, 100], got %v", c.Percent)
+	}
+	if c.MaxErrorRate < 0 || c.MaxErrorRate > 1 {
+		return fmt.Errorf("canary maxErrorRate must be within [0, 1], got %v", c.MaxErrorRate)
+	}
+	if c.MinRequests < 0 {
+		return fmt.Errorf("canary minRequests must not be negative, got %d", c.MinRequests)
+	}
+	return nil
+}
+
+type canaryStatus struct {
+	Config      canaryConfig `json:"config"`
+	RolledBack  bool         `json:"rolledBack"`
+	Requests    int          `json:"requests"`
+	Errors      int          `json:"errors"`
+	WindowStart time.Time    `json:"windowStart"`
+}
+
+type canarySplit struct {
+	mux    sync.Mutex
+	status canaryStatus
+	// loaded is the split the config file asked for last.
+	loaded canaryConfig
+}
+
+// set replaces the split configuration and clears any previous rollback.
+func (c *canarySplit) set(cfg canaryConfig) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.status = canaryStatus{Config: cfg, WindowStart: time.Now()}
+}
+
+// load takes the split from the config file when it differs from what the
+// file said before. Reloads for other reasons keep a rollback and a split
+// set through the admin API.
+func (c *canarySplit) load(cfg canaryConfig) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if cfg == c.loaded {
+		return
+	}
+	c.loaded = cfg
+	c.status = canaryStatus{Config: cfg, WindowStart: time.Now()}
+}
+
+func (c *canarySplit) current() canaryStatus {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.status
+}
+
+// choose reports whether the request should go to the canary pool.
+// pinned names the pool an affinity cookie already ties the client to,
+// which wins over the random split so that clients do not flip between
+// versions from one request to the next.
+func (c *canarySplit) choose(r *http.Request, pinned string) bool {
+	c.mux.Lock()
+	cfg, rolledBack := c.status.Config, c.status.RolledBack
+	c.mux.Unlock()
+	if rolledBack {
+		return false
+	}
+
+	preference := ""
+	if cfg.Header != "" {
+		preference = r.Header.Get(cfg.Header)
+	}
+	if cookie, err := r.Cookie(cfg.Cookie); cfg.Cookie != "" && preference == "" && err == nil {
+		preference = cookie.Value
+	}
+	switch preference {
+	case canaryAlways:
+		return true
+	case canaryNever:
+		return false
+	}
+	if pinned != "" {
+		return pinned == canaryPoolName
+	}
+	return cfg.Percent > 0 && rand.Float64()*100 < cfg.Percent
+}
+
+// record accounts a finished canary request and rolls the split back if
+// the error rate goes over the threshold.
+func (c *canarySplit) record(failed bool) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	s := &c.status
+	if time.Since(s.WindowStart) > canaryWindow {
+		s.Requests, s.Errors, s.WindowStart = 0, 0, time.Now()
+	}
+	s.Requests++
+	if failed {
+		s.Errors++
+	}
+	if s.RolledBack || s.Config.MaxErrorRate <= 0 || s.Requests < s.Config.MinRequests {
+		return
+	}
+	if rate := float64(s.Errors) / float64(s.Requests); rate > s.Config.MaxErrorRate {
+		s.RolledBack = true
+		log.Printf("Canary error rate %.2f is over %.2f, rolling back the split", rate, s.Config.MaxErrorRate)
+	}
+}
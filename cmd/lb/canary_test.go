@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanaryChoose(t *testing.T) {
+	assert := assert.New(t)
+
+	c := new(canarySplit)
+	c.set(canaryConfig{Percent: 0, Header: "X-Canary", Cookie: "canary"})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.False(c.choose(req, ""))
+	assert.True(c.choose(req, canaryPoolName), "affinity keeps the client on the canary")
+
+	req.AddCookie(&http.Cookie{Name: "canary", Value: canaryAlways})
+	assert.True(c.choose(req, stablePoolName))
+
+	req.Header.Set("X-Canary", canaryNever)
+	assert.False(c.choose(req, canaryPoolName))
+
+	c.set(canaryConfig{Percent: 100})
+	assert.True(c.choose(httptest.NewRequest("GET", "/", nil), ""))
+	assert.False(c.choose(httptest.NewRequest("GET", "/", nil), stablePoolName))
+}
+
+func TestCanaryRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	c := new(canarySplit)
+	c.set(canaryConfig{Percent: 100, MaxErrorRate: 0.5, MinRequests: 4})
+	c.record(true)
+	c.record(true)
+	c.record(true)
+	assert.False(c.current().RolledBack, "not enough requests to judge")
+
+	c.record(false)
+	assert.True(c.current().RolledBack)
+	assert.False(c.choose(httptest.NewRequest("GET", "/", nil), canaryPoolName))
+
+	c.set(canaryConfig{Percent: 100})
+	assert.False(c.current().RolledBack)
+}
+
+func TestCanaryReload(t *testing.T) {
+	assert := assert.New(t)
+
+	c := new(canarySplit)
+	c.load(canaryConfig{Percent: 100, MaxErrorRate: 0.5})
+	c.record(true)
+	assert.True(c.current().RolledBack)
+	c.load(canaryConfig{Percent: 100, MaxErrorRate: 0.5})
+	assert.True(c.current().RolledBack, "reloading the same config keeps the rollback")
+
+	c.set(canaryConfig{Percent: 30})
+	c.load(canaryConfig{Percent: 100, MaxErrorRate: 0.5})
+	assert.Equal(30.0, c.current().Config.Percent, "reloading the same config keeps the split set at runtime")
+
+	c.load(canaryConfig{Percent: 50})
+	assert.Equal(50.0, c.current().Config.Percent)
+	assert.False(c.current().RolledBack)
+}
+
+func TestCanaryAdmin(t *testing.T) {
+	assert := assert.New(t)
+
+	defer canary.set(canary.current().Config)
+	h := adminHandler()
+
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("PUT", "/canary", strings.NewReader(`{"percent": 25}`)))
+	assert.Equal(http.StatusOK, rw.Code)
+	assert.Equal(25.0, canary.current().Config.Percent)
+
+	rw = httptest.NewRecorder()
+	h.ServeHTTP(rw, httptest.NewRequest("PUT", "/canary", strings.NewReader(`{"percent": 250}`)))
+	assert.Equal(http.StatusBadRequest, rw.Code)
+	assert.Equal(25.0, canary.current().Config.Percent)
+}
+
+func TestLoadConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.json")
+
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"canary": {"percent": 10, "header": "X-Canary"}}`), 0o600))
+	cfg, err := loadConfig(path)
+	assert.Nil(err)
+	assert.Equal(10.0, cfg.Canary.Percent)
+	assert.Equal("X-Canary", cfg.Canary.Header)
+
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"canary": {"percent": -1}}`), 0o600))
+	_, err = loadConfig(path)
+	assert.NotNil(err)
+}
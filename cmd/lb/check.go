@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+)
+
+// checkReport collects the results of a config check.
+type checkReport struct {
+	out    io.Writer
+	errors int
+}
+
+func (c *checkReport) ok(format string, args ...interface{}) {
+	fmt.Fprintf(c.out, "ok    "+format+"\n", args...)
+}
+
+func (c *checkReport) fail(format string, args ...interface{}) {
+	c.errors++
+	fmt.Fprintf(c.out, "FAIL  "+format+"\n", args...)
+}
+
+// checkConfig validates the flags and the config file without starting
+// the balancer: it resolves every server and, if probe is set, runs one
+// health check against each of them. It returns the number of problems.
+func checkConfig(out io.Writer, probe bool) int {
+	c := &checkReport{out: out}
+
+	cfg := new(config)
+	if *configPath != "" {
+		loaded, err := loadConfig(*configPath)
+		if err != nil {
+			c.fail("config %s: %s", *configPath, err)
+		} else {
+			cfg = loaded
+			c.ok("config %s: %d pools, %d routes", *configPath, len(cfg.Pools), len(cfg.Routes))
+		}
+	}
+
+	if *mode != modeHTTP && *mode != modeTCP {
+		c.fail("mode: unknown mode %q", *mode)
+	} else {
+		c.ok("mode %s", *mode)
+	}
+	if _, err := strategyByName(strategyOrDefault(*strategyName, *mode)); err != nil {
+		c.fail("strategy: %s", err)
+	} else {
+		c.ok("strategy %s", strategyOrDefault(*strategyName, *mode))
+	}
+
+	if *adaptiveLimit > 0 && *adaptiveTolerance < 1 {
+		c.fail("adaptive limits: tolerance must be at least 1, got %v", *adaptiveTolerance)
+	}
+
+	if err := validateZoneFlags(); err != nil {
+		c.fail("zones: %s", err)
+	} else if *zone != "" {
+		c.ok("zone %s", *zone)
+	}
+
+	if _, err := parseCIDRs(*proxyProtocolFrom); err != nil {
+		c.fail("proxy protocol: %s", err)
+	}
+	if v := *proxyProtocolUpstream; v != "" && v != proxyProtocolV1 && v != proxyProtocolV2 {
+		c.fail("proxy protocol: unknown version %q", v)
+	}
+
+	if *tlsCert != "" {
+		if _, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey); err != nil {
+			c.fail("tls: %s", err)
+		} else {
+			c.ok("tls certificate %s", *tlsCert)
+		}
+	}
+	if _, err := newAccessLogger("", *accessLogFormat, *accessLogSample); err != nil {
+		c.fail("access log: %s", err)
+	}
+	if err := cfg.Canary.validate(); err == nil && cfg.Canary.Percent > 0 && len(canaryServersOf(cfg)) == 0 {
+		c.fail("canary: %v%% of traffic is split to an empty canary pool", cfg.Canary.Percent)
+	}
+
+	shadowPool = parseHosts(*shadowServers)
+	canaryPool = parseHosts(*canaryServers)
+	setupPools(cfg.Pools)
+	var names []string
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, s := range pools[name].servers {
+			checkServer(c, name, s, probe)
+		}
+	}
+
+	if c.errors > 0 {
+		fmt.Fprintf(out, "%d problems found\n", c.errors)
+	} else {
+		fmt.Fprintln(out, "config is valid")
+	}
+	return c.errors
+}
+
+func canaryServersOf(cfg *config) []string {
+	if pc, ok := cfg.Pools[canaryPoolName]; ok && len(pc.Servers) > 0 {
+		return pc.Servers
+	}
+	var hosts []string
+	for _, s := range parseHosts(*canaryServers) {
+		hosts = append(hosts, s.host)
+	}
+	return hosts
+}
+
+func checkServer(c *checkReport, pool string, s *server, probe bool) {
+	if path, ok := unixSocketPath(s.host); ok {
+		if fi, err := os.Stat(path); err != nil {
+			c.fail("server %s (%s): %s", s.host, pool, err)
+			return
+		} else if fi.Mode()&os.ModeSocket == 0 {
+			c.fail("server %s (%s): %s is not a socket", s.host, pool, path)
+			return
+		}
+		c.ok("server %s (%s) socket exists", s.host, pool)
+	} else {
+		host, _, err := net.SplitHostPort(s.host)
+		if err != nil {
+			c.fail("server %s (%s): %s", s.host, pool, err)
+			return
+		}
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			c.fail("server %s (%s): %s", s.host, pool, err)
+			return
+		}
+		c.ok("server %s (%s) resolves to %v", s.host, pool, addrs)
+	}
+	if !probe {
+		return
+	}
+	if checkHealth(s) {
+		c.ok("server %s (%s) is healthy", s.host, pool)
+	} else {
+		c.fail("server %s (%s) failed its health check", s.host, pool)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	dir, err := ioutil.TempDir("", "test-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.json")
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"pools": {"canary": {"servers": ["`+backendHost(down)+`"]}}}`), 0o600))
+
+	defer func(old []*server, oldPath, oldStrategy string) {
+		serversPool, *configPath, *strategyName = old, oldPath, oldStrategy
+		canaryPool, shadowPool = nil, nil
+		pools = make(map[string]*pool)
+	}(serversPool, *configPath, *strategyName)
+	serversPool = parseHosts(backendHost(backend))
+	*configPath = path
+
+	var out bytes.Buffer
+	assert.Equal(0, checkConfig(&out, false), out.String())
+	assert.Contains(out.String(), "config is valid")
+
+	out.Reset()
+	assert.Equal(1, checkConfig(&out, true))
+	assert.Contains(out.String(), "FAIL  server "+backendHost(down)+" (canary) failed its health check")
+	assert.Contains(out.String(), "ok    server "+backendHost(backend)+" (stable) is healthy")
+
+	*strategyName = "round-robin"
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"routes": [{"prefix": "api"}]}`), 0o600))
+	out.Reset()
+	assert.Equal(2, checkConfig(&out, false))
+	assert.Contains(out.String(), "FAIL  strategy")
+	assert.Contains(out.String(), "FAIL  config")
+	assert.Contains(out.String(), "2 problems found")
+}
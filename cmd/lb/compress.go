@@ -0,0 +1,268 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"expvar"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+
+	// eventStreamType is only compressed when listed by itself, type/*
+	// does not cover it: events must reach clients as they are sent.
+	eventStreamType = "text/event-stream"
+	// streamFlushInterval is how often responses of unknown length are
+	// flushed to clients while being copied.
+	streamFlushInterval = 100 * time.Millisecond
+)
+
+var (
+	compressedResponses = expvar.NewInt("lb_compressed_responses_total")
+	compressibleTypes   []string
+)
+
+// parseContentTypes reads a comma-separated list of media types, where
+// type/* stands for every subtype.
+func parseContentTypes(list string) []string {
+	var res []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func compressible(contentType string) bool {
+	media, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range compressibleTypes {
+		if allowed == media {
+			return true
+		}
+		if media != eventStreamType && strings.HasSuffix(allowed, "/*") && strings.HasPrefix(media, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEventStream(resp *http.Response) bool {
+	media, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return media == eventStreamType
+}
+
+// acceptedEncoding picks gzip or deflate, whichever Accept-Encoding
+// prefers, gzip on a tie; empty if the client takes neither.
+func acceptedEncoding(r *http.Request) string {
+	qs := make(map[string]float64)
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(header, ",") {
+			parts := strings.Split(item, ";")
+			q := 1.0
+			for _, param := range parts[1:] {
+				if param = strings.TrimSpace(param); strings.HasPrefix(param, "q=") {
+					q, _ = strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				}
+			}
+			qs[strings.ToLower(strings.TrimSpace(parts[0]))] = q
+		}
+	}
+	quality := func(encoding string) float64 {
+		if q, ok := qs[encoding]; ok {
+			return q
+		}
+		return qs["*"]
+	}
+	gzipQ, deflateQ := quality(encodingGzip), quality(encodingDeflate)
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return encodingGzip
+	case deflateQ > 0:
+		return encodingDeflate
+	}
+	return ""
+}
+
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressWriter encodes responses of compressible types. Bodies of
+// unknown length are held back until they reach minSize, smaller ones
+// are sent as they are.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status      int
+	held        []byte
+	passthrough bool
+	encoder     flushWriteCloser
+}
+
+func newCompressWriter(rw http.ResponseWriter, r *http.Request, minSize int) *compressWriter {
+	return &compressWriter{ResponseWriter: rw, encoding: acceptedEncoding(r), minSize: minSize}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 {
+		return
+	}
+	cw.status = status
+	h := cw.Header()
+	eligible := status >= http.StatusOK && status != http.StatusNoContent &&
+		status != http.StatusPartialContent && status != http.StatusNotModified &&
+		h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type"))
+	if eligible {
+		// Caches must tell apart clients that get a compressed body.
+		addVary(h, "Accept-Encoding")
+	}
+	length, err := strconv.Atoi(h.Get("Content-Length"))
+	switch {
+	case !eligible || cw.encoding == "" || err == nil && length < cw.minSize:
+		cw.passthrough = true
+		cw.ResponseWriter.WriteHeader(status)
+	case err == nil:
+		cw.start()
+	}
+}
+
+func (cw *compressWriter) Write(data []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch {
+	case cw.passthrough:
+		return cw.ResponseWriter.Write(data)
+	case cw.encoder != nil:
+		return cw.encoder.Write(data)
+	}
+	cw.held = append(cw.held, data...)
+	if len(cw.held) >= cw.minSize {
+		cw.start()
+	}
+	return len(data), nil
+}
+
+// start sends the headers of a compressed response and what was held.
+func (cw *compressWriter) start() {
+	h := cw.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoding)
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if cw.encoding == encodingGzip {
+		cw.encoder = gzip.NewWriter(cw.ResponseWriter)
+	} else {
+		cw.encoder = zlib.NewWriter(cw.ResponseWriter)
+	}
+	compressedResponses.Add(1)
+	if len(cw.held) > 0 {
+		_, _ = cw.encoder.Write(cw.held)
+		cw.held = nil
+	}
+}
+
+// Flush sends what was written so far, compressing it if the response
+// was held back.
+func (cw *compressWriter) Flush() {
+	if cw.status != 0 && !cw.passthrough && cw.encoder == nil {
+		cw.start()
+	}
+	if cw.encoder != nil {
+		_ = cw.encoder.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close finishes the response once the handler is done with it.
+func (cw *compressWriter) close() {
+	switch {
+	case cw.encoder != nil:
+		_ = cw.encoder.Close()
+	case cw.status != 0 && !cw.passthrough:
+		cw.Header().Set("Content-Length", strconv.Itoa(len(cw.held)))
+		cw.ResponseWriter.WriteHeader(cw.status)
+		_, _ = cw.ResponseWriter.Write(cw.held)
+	}
+}
+
+// copyFlushingEvery copies a response body of unknown length, flushing
+// what was written at most interval after it was, so that slow streams
+// are not held back for compression.
+func copyFlushingEvery(rw http.ResponseWriter, body io.Reader, interval time.Duration) (int64, error) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return io.Copy(rw, body)
+	}
+	fw := &intervalFlusher{rw: rw, flusher: flusher, interval: interval}
+	defer fw.stop()
+	return io.Copy(fw, body)
+}
+
+type intervalFlusher struct {
+	rw       http.ResponseWriter
+	flusher  http.Flusher
+	interval time.Duration
+
+	mux     sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func (fw *intervalFlusher) Write(data []byte) (int, error) {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	n, err := fw.rw.Write(data)
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(fw.interval, fw.flush)
+	}
+	return n, err
+}
+
+func (fw *intervalFlusher) flush() {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	if !fw.stopped {
+		fw.flusher.Flush()
+		fw.timer = nil
+	}
+}
+
+func (fw *intervalFlusher) stop() {
+	fw.mux.Lock()
+	defer fw.mux.Unlock()
+	fw.stopped = true
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+}
+
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "*" || strings.EqualFold(item, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	for header, want := range map[string]string{
+		"":                         "",
+		"gzip":                     encodingGzip,
+		"deflate":                  encodingDeflate,
+		"gzip, deflate, br":        encodingGzip,
+		"gzip;q=0.5, deflate":      encodingDeflate,
+		"gzip;q=0, deflate;q=0":    "",
+		"br":                       "",
+		"*":                        encodingGzip,
+		"*, gzip;q=0":              encodingDeflate,
+		"identity, GZIP ; q=0.8":   encodingGzip,
+		"deflate;q=0.3, gzip;q=.3": encodingGzip,
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		if header != "" {
+			r.Header.Set("Accept-Encoding", header)
+		}
+		assert.Equal(want, acceptedEncoding(r), header)
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(old []string) { compressibleTypes = old }(compressibleTypes)
+	compressibleTypes = parseContentTypes("application/json, text/*")
+	assert.True(compressible("application/json; charset=utf-8"))
+	assert.True(compressible("text/html"))
+	assert.False(compressible("image/png"))
+	assert.False(compressible("application/jsonp"))
+	assert.False(compressible(""))
+	assert.False(compressible("text/event-stream"), "events are never held back by type/*")
+	compressibleTypes = parseContentTypes("text/event-stream")
+	assert.True(compressible("text/event-stream"))
+}
+
+func TestCompressedResponses(t *testing.T) {
+	assert := assert.New(t)
+
+	large := `{"data": "` + strings.Repeat("a", 4096) + `"}`
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body := large
+		if r.URL.Query().Get("size") == "small" {
+			body = `{"data": "a"}`
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("ETag", `"v1"`)
+		switch r.URL.Path {
+		case "/image":
+			rw.Header().Set("Content-Type", "image/png")
+		case "/encoded":
+			rw.Header().Set("Content-Encoding", "br")
+		case "/stream":
+			// Unknown length, sent in pieces.
+			for i := 0; i < len(body); i += 100 {
+				_, _ = rw.Write([]byte(body[i:min(i+100, len(body))]))
+				rw.(http.Flusher).Flush()
+			}
+			return
+		}
+		rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		_, _ = rw.Write([]byte(body))
+	}))
+	defer backend.Close()
+	defer func(old []*server, enabled bool, types []string) {
+		serversPool, *compression, compressibleTypes = old, enabled, types
+	}(serversPool, *compression, compressibleTypes)
+	serversPool = parseHosts(backendHost(backend))
+	*compression = true
+	compressibleTypes = parseContentTypes(*compressTypes)
+
+	send := func(target, acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rw := httptest.NewRecorder()
+		handleRequest(rw, r)
+		return rw
+	}
+	gunzip := func(data []byte) string {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err.Error()
+		}
+		res, _ := ioutil.ReadAll(zr)
+		return string(res)
+	}
+
+	for _, target := range []string{"/api/v1/some-data", "/stream"} {
+		rw := send(target, "gzip, deflate")
+		assert.Equal(encodingGzip, rw.Header().Get("Content-Encoding"), target)
+		assert.Empty(rw.Header().Get("Content-Length"), target)
+		assert.Equal("Accept-Encoding", rw.Header().Get("Vary"), target)
+		assert.Equal(large, gunzip(rw.Body.Bytes()), target)
+		assert.Less(rw.Body.Len(), len(large))
+	}
+	rw := send("/api/v1/some-data", "gzip")
+	assert.Equal(`W/"v1"`, rw.Header().Get("ETag"))
+
+	rw = send("/api/v1/some-data", "deflate")
+	assert.Equal(encodingDeflate, rw.Header().Get("Content-Encoding"))
+	zr, err := zlib.NewReader(rw.Body)
+	if assert.Nil(err) {
+		body, _ := ioutil.ReadAll(zr)
+		assert.Equal(large, string(body))
+	}
+
+	// Clients that do not ask, small bodies and other types go as they are.
+	for _, c := range []struct {
+		target, acceptEncoding, vary string
+	}{
+		{"/api/v1/some-data", "", "Accept-Encoding"},
+		{"/api/v1/some-data?size=small", "gzip", "Accept-Encoding"},
+		{"/stream?size=small", "gzip", "Accept-Encoding"},
+		{"/image", "gzip", ""},
+		{"/encoded", "gzip", ""},
+	} {
+		rw := send(c.target, c.acceptEncoding)
+		name := c.target + " " + c.acceptEncoding
+		assert.Equal(c.vary, rw.Header().Get("Vary"), name)
+		assert.Equal(strconv.Itoa(rw.Body.Len()), rw.Header().Get("Content-Length"), name)
+		assert.NotEqual(encodingGzip, rw.Header().Get("Content-Encoding"), name)
+		assert.Equal(`"v1"`, rw.Header().Get("ETag"), name)
+	}
+	assert.Equal("br", send("/encoded", "gzip").Header().Get("Content-Encoding"))
+
+	// The access log counts the bytes sent, not the ones compressed.
+	dir, err := ioutil.TempDir("", "test-compress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old *accessLogger) { accessLog = old }(accessLog)
+	accessLog, _ = newAccessLogger(filepath.Join(dir, "access.log"), logFormatJSON, 1)
+	rw = send("/api/v1/some-data", "gzip")
+	logged, _ := ioutil.ReadFile(filepath.Join(dir, "access.log"))
+	var entry accessEntry
+	assert.Nil(json.Unmarshal(logged, &entry))
+	assert.Equal(int64(rw.Body.Len()), entry.Bytes)
+}
+
+func TestCompressedStreams(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		_, _ = rw.Write([]byte("data: first\n\n"))
+		rw.(http.Flusher).Flush()
+		<-release
+	}))
+	defer backend.Close()
+	frontend := httptest.NewServer(http.HandlerFunc(handleRequest))
+	defer frontend.Close()
+	defer close(release)
+	defer func(old []*server, enabled bool, types []string) {
+		serversPool, *compression, compressibleTypes = old, enabled, types
+	}(serversPool, *compression, compressibleTypes)
+	serversPool = parseHosts(backendHost(backend))
+	*compression = true
+	compressibleTypes = parseContentTypes(*compressTypes)
+
+	// Streams reach clients before they end, compressed or not.
+	for _, contentType := range []string{"text/event-stream", "application/json"} {
+		r, _ := http.NewRequest("GET", frontend.URL+"/events?type="+contentType, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		if !assert.Nil(err) {
+			continue
+		}
+		defer resp.Body.Close()
+		var body io.Reader = resp.Body
+		if contentType == "application/json" {
+			assert.Equal(encodingGzip, resp.Header.Get("Content-Encoding"))
+			zr, err := gzip.NewReader(resp.Body)
+			if !assert.Nil(err) {
+				continue
+			}
+			body = zr
+		} else {
+			assert.Empty(resp.Header.Get("Content-Encoding"))
+		}
+		line, err := bufio.NewReader(body).ReadString('\n')
+		assert.Nil(err)
+		assert.Equal("data: first\n", line, contentType)
+	}
+}
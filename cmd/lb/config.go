@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// config holds the balancer settings read from the file passed with
+// -config. Everything except pools can be changed at runtime by editing
+// the file and sending SIGHUP.
+type config struct {
+	Pools  map[string]poolConfig `json:"pools"`
+	Routes []routeConfig         `json:"routes"`
+	Canary canaryConfig          `json:"canary"`
+	Access accessConfig          `json:"access"`
+	// TrustedProxies are addresses or CIDRs of proxies in front of the
+	// balancer whose X-Forwarded-For tells the client address.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+
+	trusted []*net.IPNet
+}
+
+func loadConfig(path string) (*config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(config)
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %s", path, err)
+	}
+	if err := cfg.Canary.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Access.parse(); err != nil {
+		return nil, err
+	}
+	if cfg.trusted, err = parseCIDRs(strings.Join(cfg.TrustedProxies, ",")); err != nil {
+		return nil, fmt.Errorf("trustedProxies: %s", err)
+	}
+	for name, pc := range cfg.Pools {
+		if err := pc.validate(); err != nil {
+			return nil, fmt.Errorf("pool %s: %s", name, err)
+		}
+	}
+	for i := range cfg.Routes {
+		if err := cfg.Routes[i].validate(); err != nil {
+			return nil, err
+		}
+		// Pools are set up once, a route can only name one known at start.
+		if pool := cfg.Routes[i].Pool; pool != "" && pool != stablePoolName {
+			if _, ok := cfg.Pools[pool]; !ok {
+				return nil, fmt.Errorf("route %s: unknown pool %q", cfg.Routes[i].Prefix, pool)
+			}
+		}
+		if err := cfg.Routes[i].load(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// checkReload rejects a reloaded config that defines pools the balancer
+// did not set up at startup, routes would have no servers to go to.
+func (cfg *config) checkReload() error {
+	for name := range cfg.Pools {
+		if !poolRegistered(name) {
+			return fmt.Errorf("pool %s is new, pools only change on restart", name)
+		}
+	}
+	return nil
+}
+
+func applyConfig(cfg *config) {
+	routes.set(cfg.Routes)
+	canary.load(cfg.Canary)
+	access.set(cfg.Access, cfg.trusted)
+}
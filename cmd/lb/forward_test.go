@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
+	"github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func backendHost(s *httptest.Server) string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+func TestForwardRetriesWithTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	exported := make(chan map[string]interface{}, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		exported <- req
+	}))
+	defer collector.Close()
+	exporter, _ := tracing.NewExporter(collector.URL)
+	defer func(old *tracing.Tracer) { tracer = old }(tracer)
+	tracer = tracing.NewTracer("lb", exporter)
+
+	var received http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	}))
+	defer backend.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	defer func(old []*server, oldRetries int) { serversPool, *retries = old, oldRetries }(serversPool, *retries)
+	serversPool = []*server{
+		{host: backendHost(down), isHealthy: true},
+		{host: backendHost(backend), isHealthy: true, traffic: 1},
+	}
+	*retries = 1
+
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	handleRequest(rw, req)
+	tracer.Flush()
+
+	assert.Equal(http.StatusOK, rw.Code)
+	sc, ok := tracing.Extract(received)
+	assert.True(ok)
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+
+	spans := (<-exported)["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	var names []string
+	for _, span := range spans {
+		span := span.(map[string]interface{})
+		assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span["traceId"])
+		names = append(names, span["name"].(string))
+	}
+	assert.Equal([]string{"forward", "forward", "lb"}, names)
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	assert := assert.New(t)
+
+	var received string
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(httptools.RequestIDHeader)
+		rw.Header().Set(httptools.RequestIDHeader, received)
+	}))
+	defer backend.Close()
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(backend))
+
+	req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.Header.Set(httptools.RequestIDHeader, "client-chosen-id")
+	rw := httptest.NewRecorder()
+	handleRequest(rw, req)
+	assert.Equal("client-chosen-id", received)
+	assert.Equal([]string{"client-chosen-id"}, rw.Header().Values(httptools.RequestIDHeader))
+
+	req = httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	req.Header.Set(httptools.RequestIDHeader, "bad id\x7f")
+	rw = httptest.NewRecorder()
+	handleRequest(rw, req)
+	assert.Len(received, 16)
+	assert.Equal(received, rw.Header().Get(httptools.RequestIDHeader))
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("data"))
+	}))
+	defer backend.Close()
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(backend) + ", " + backendHost(backend))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			handleRequest(rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+			assert.Equal(t, http.StatusOK, rw.Code)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 80, serversPool[0].traffic+serversPool[1].traffic)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gossipFanout     = 2
+	maxGossipMessage = 64 * 1024
+)
+
+var (
+	gossipReceived      = expvar.NewInt("lb_gossip_messages_received_total")
+	gossipRejected      = expvar.NewInt("lb_gossip_messages_rejected_total")
+	healthProbes        = expvar.NewInt("lb_health_probes_total")
+	healthProbesSkipped = expvar.NewInt("lb_health_probes_skipped_total")
+)
+
+// observation is what one balancer last saw of a server. Seq grows with
+// every observation of its node, Age is how long ago the node made it.
+// Neither depends on the clocks of balancers agreeing.
+type observation struct {
+	Host    string `json:"host"`
+	Healthy bool   `json:"healthy"`
+	Node    string `json:"node"`
+	Seq     uint64 `json:"seq"`
+	Age     int64  `json:"ageMs"`
+
+	// at is when the observation was made by the local clock.
+	at time.Time
+}
+
+type gossipMessage struct {
+	From         string        `json:"from"`
+	Observations []observation `json:"observations"`
+}
+
+type observationKey struct {
+	node, host string
+}
+
+// gossiper shares server observations with peer balancers over UDP. Every
+// instance pushes its own observations to a few random peers periodically
+// and right after it probes a server; the observation that arrived last
+// wins. Messages carry an HMAC of the shared key and are only taken from
+// configured peers.
+type gossiper struct {
+	node  string
+	key   []byte
+	conn  *net.UDPConn
+	peers []*net.UDPAddr
+	done  chan struct{}
+
+	mux   sync.Mutex
+	seq   uint64
+	state map[string]observation
+	seen  map[observationKey]uint64
+}
+
+func newGossiper(node, listen, key string, peers []string) (*gossiper, error) {
+	if key == "" {
+		return nil, errors.New("no key to sign messages with")
+	}
+	conn, err := listenGossip(listen)
+	if err != nil {
+		return nil, err
+	}
+	g := &gossiper{
+		node:  node,
+		key:   []byte(key),
+		conn:  conn,
+		done:  make(chan struct{}),
+		state: make(map[string]observation),
+		seen:  make(map[observationKey]uint64),
+		// Peers drop what is not newer than they have seen from a node,
+		// a restarted node must not start over.
+		seq: uint64(time.Now().UnixNano()),
+	}
+	for _, peer := range peers {
+		if peer = strings.TrimSpace(peer); peer == "" {
+			continue
+		}
+		peerAddr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		g.peers = append(g.peers, peerAddr)
+	}
+	return g, nil
+}
+
+func (g *gossiper) start(interval time.Duration) {
+	go g.receive()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.push(g.own())
+			case <-g.done:
+				return
+			}
+		}
+	}()
+}
+
+// observe records a local probe result and spreads it at once.
+func (g *gossiper) observe(host string, healthy bool) {
+	if g == nil {
+		return
+	}
+	g.mux.Lock()
+	g.seq++
+	o := observation{Host: host, Healthy: healthy, Node: g.node, Seq: g.seq, at: time.Now()}
+	g.state[host] = o
+	g.mux.Unlock()
+	g.push([]observation{o})
+}
+
+// fresh returns an observation of host made by a peer within maxAge.
+func (g *gossiper) fresh(host string, maxAge time.Duration) (observation, bool) {
+	if g == nil {
+		return observation{}, false
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	o, ok := g.state[host]
+	if !ok || o.Node == g.node || time.Since(o.at) > maxAge {
+		return observation{}, false
+	}
+	return o, true
+}
+
+// own returns the observations this node made itself and still stands by.
+// Relaying those of others would make them look fresh forever.
+func (g *gossiper) own() []observation {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	var res []observation
+	for _, o := range g.state {
+		if o.Node == g.node {
+			res = append(res, o)
+		}
+	}
+	return res
+}
+
+// merge takes observations of a peer that are newer than what it sent
+// before and applies them to local servers straight away.
+func (g *gossiper) merge(from string, observations []observation) {
+	now := time.Now()
+	for _, o := range observations {
+		if o.Node != from || o.Node == g.node {
+			continue
+		}
+		key := observationKey{o.Node, o.Host}
+		g.mux.Lock()
+		newer := o.Seq > g.seen[key]
+		if newer {
+			g.seen[key] = o.Seq
+			if o.Age < 0 {
+				o.Age = 0
+			}
+			o.at = now.Add(-time.Duration(o.Age) * time.Millisecond)
+			g.state[o.Host] = o
+		}
+		g.mux.Unlock()
+		if s := findServer(o.Host); newer && s != nil {
+			setHealthy(s, o.Healthy)
+		}
+	}
+}
+
+func (g *gossiper) sign(data []byte) []byte {
+	mac := hmac.New(sha256.New, g.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// open checks that a message comes from a peer and was signed with the
+// shared key, and returns its payload.
+func (g *gossiper) open(data []byte, from *net.UDPAddr) ([]byte, bool) {
+	if len(data) < sha256.Size || !g.isPeer(from) {
+		return nil, false
+	}
+	payload := data[sha256.Size:]
+	return payload, hmac.Equal(data[:sha256.Size], g.sign(payload))
+}
+
+func (g *gossiper) isPeer(addr *net.UDPAddr) bool {
+	for _, peer := range g.peers {
+		if peer.IP.Equal(addr.IP) && peer.Port == addr.Port {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *gossiper) push(observations []observation) {
+	if len(observations) == 0 || len(g.peers) == 0 {
+		return
+	}
+	now := time.Now()
+	for i := range observations {
+		observations[i].Age = now.Sub(observations[i].at).Milliseconds()
+	}
+	payload, err := json.Marshal(gossipMessage{From: g.node, Observations: observations})
+	data := append(g.sign(payload), payload...)
+	if err != nil || len(data) > maxGossipMessage {
+		log.Printf("Gossip message of %d observations is too big", len(observations))
+		return
+	}
+	for _, i := range rand.Perm(len(g.peers))[:min(gossipFanout, len(g.peers))] {
+		if _, err := g.conn.WriteToUDP(data, g.peers[i]); err != nil {
+			log.Printf("Failed to gossip to %s: %s", g.peers[i], err)
+		}
+	}
+}
+
+func (g *gossiper) receive() {
+	buf := make([]byte, maxGossipMessage)
+	for {
+		n, from, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		payload, ok := g.open(buf[:n], from)
+		var msg gossipMessage
+		if !ok || json.Unmarshal(payload, &msg) != nil {
+			gossipRejected.Add(1)
+			continue
+		}
+		gossipReceived.Add(1)
+		g.merge(msg.From, msg.Observations)
+	}
+}
+
+func (g *gossiper) close() error {
+	close(g.done)
+	return g.conn.Close()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startGossipers(t *testing.T, names ...string) []*gossiper {
+	var nodes []*gossiper
+	for _, name := range names {
+		g, err := newGossiper(name, "127.0.0.1:0", "secret", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, g)
+	}
+	for _, g := range nodes {
+		for _, peer := range nodes {
+			if peer != g {
+				g.peers = append(g.peers, peer.conn.LocalAddr().(*net.UDPAddr))
+			}
+		}
+	}
+	return nodes
+}
+
+func eventually(condition func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestGossipSpreadsObservations(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts("server1:8080")
+
+	nodes := startGossipers(t, "lb1", "lb2", "lb3")
+	for _, g := range nodes {
+		defer g.close()
+		g.start(time.Hour)
+	}
+
+	nodes[0].observe("server1:8080", false)
+	for _, g := range nodes[1:] {
+		g := g
+		assert.True(eventually(func() bool {
+			_, ok := g.fresh("server1:8080", time.Minute)
+			return ok
+		}))
+		o, _ := g.fresh("server1:8080", time.Minute)
+		assert.False(o.Healthy)
+		assert.Equal("lb1", o.Node)
+	}
+	_, ok := nodes[0].fresh("server1:8080", time.Minute)
+	assert.False(ok, "own observations do not replace probing")
+	assert.True(eventually(func() bool {
+		backendLimiter.mux.Lock()
+		defer backendLimiter.mux.Unlock()
+		return !serversPool[0].isHealthy
+	}), "remote observations are applied to local servers")
+}
+
+func TestGossipAntiEntropy(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes := startGossipers(t, "lb1", "lb2")
+	for _, g := range nodes {
+		defer g.close()
+	}
+	// lb2 learns about the observation made before it started listening,
+	// as old as it was when lb1 made it.
+	nodes[0].state["server2:8080"] = observation{Host: "server2:8080", Healthy: true, Node: "lb1", Seq: 1, at: time.Now().Add(-time.Minute)}
+	nodes[0].start(10 * time.Millisecond)
+	go nodes[1].receive()
+
+	assert.True(eventually(func() bool {
+		_, ok := nodes[1].fresh("server2:8080", 2*time.Minute)
+		return ok
+	}))
+	_, ok := nodes[1].fresh("server2:8080", 30*time.Second)
+	assert.False(ok)
+}
+
+func TestGossipMerge(t *testing.T) {
+	assert := assert.New(t)
+
+	g := startGossipers(t, "lb1")[0]
+	defer g.close()
+	seen := func(host string) bool {
+		o, ok := g.fresh(host, time.Minute)
+		return ok && o.Healthy
+	}
+
+	g.merge("lb2", []observation{{Host: "a:8080", Healthy: true, Node: "lb2", Seq: 5}})
+	assert.True(seen("a:8080"))
+	g.merge("lb2", []observation{{Host: "a:8080", Healthy: false, Node: "lb2", Seq: 4}})
+	assert.True(seen("a:8080"), "older observations of a node are dropped")
+	g.merge("lb3", []observation{{Host: "a:8080", Healthy: false, Node: "lb3", Seq: 1}})
+	assert.False(seen("a:8080"), "the last observation to arrive wins")
+
+	g.merge("lb2", []observation{{Host: "b:8080", Healthy: true, Node: "lb3", Seq: 1}})
+	g.merge("lb2", []observation{{Host: "b:8080", Healthy: true, Node: "lb1", Seq: 1}})
+	assert.False(seen("b:8080"), "nodes only speak for themselves")
+}
+
+func TestGossipRejectsStrangers(t *testing.T) {
+	assert := assert.New(t)
+
+	nodes := startGossipers(t, "lb1", "lb2")
+	for _, g := range nodes {
+		defer g.close()
+	}
+	stranger, err := newGossiper("lb3", "127.0.0.1:0", "secret", []string{nodes[0].conn.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.close()
+	forger := nodes[1]
+	forger.key = []byte("guess")
+	go nodes[0].receive()
+
+	before := gossipRejected.Value()
+	stranger.observe("server1:8080", false)
+	forger.observe("server1:8080", false)
+	assert.True(eventually(func() bool {
+		return gossipRejected.Value() == before+2
+	}))
+	_, ok := nodes[0].fresh("server1:8080", time.Minute)
+	assert.False(ok)
+
+	_, err = newGossiper("lb4", "127.0.0.1:0", "", nil)
+	assert.NotNil(err)
+}
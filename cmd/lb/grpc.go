@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
+)
+
+const (
+	grpcContentType  = "application/grpc"
+	grpcHealthMethod = "/grpc.health.v1.Health/Check"
+
+	// Codes from https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+	grpcOK                = 0
+	grpcCancelled         = 1
+	grpcUnknown           = 2
+	grpcDeadlineExceeded  = 4
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcUnimplemented     = 12
+	grpcUnavailable       = 14
+	grpcUnauthenticated   = 16
+
+	// HealthCheckResponse.ServingStatus.SERVING
+	grpcServing = 1
+)
+
+func isGRPC(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("content-type"), grpcContentType)
+}
+
+// grpcCodeFromHTTP maps HTTP statuses of responses without grpc-status
+// as described in doc/http-grpc-status-mapping.md of the gRPC repository.
+func grpcCodeFromHTTP(status int) int {
+	switch status {
+	case http.StatusBadRequest:
+		return grpcInternal
+	case http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case http.StatusForbidden:
+		return grpcPermissionDenied
+	case http.StatusNotFound:
+		return grpcUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return grpcUnavailable
+	}
+	return grpcUnknown
+}
+
+// grpcTimeout reads the call deadline a gRPC client sent in grpc-timeout,
+// an up to 8 digit number followed by a unit.
+func grpcTimeout(r *http.Request) (duration, bool) {
+	value := r.Header.Get("grpc-timeout")
+	if len(value) < 2 || len(value) > 9 {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	var unit time.Duration
+	switch value[len(value)-1] {
+	case 'H':
+		unit = time.Hour
+	case 'M':
+		unit = time.Minute
+	case 'S':
+		unit = time.Second
+	case 'm':
+		unit = time.Millisecond
+	case 'u':
+		unit = time.Microsecond
+	case 'n':
+		unit = time.Nanosecond
+	default:
+		return 0, false
+	}
+	return duration(time.Duration(n) * unit), true
+}
+
+// writeGRPCError sends a trailers-only gRPC response carrying the failure.
+func writeGRPCError(rw http.ResponseWriter, code int, message string) {
+	rw.Header().Set("content-type", grpcContentType)
+	rw.Header().Set("grpc-status", strconv.Itoa(code))
+	if message != "" {
+		rw.Header().Set("grpc-message", message)
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// setGRPCFailure ends a stream that broke after the headers were sent
+// with trailers carrying the failure, so the call does not look complete.
+func setGRPCFailure(rw http.ResponseWriter, err error) {
+	code := grpcUnavailable
+	if isTimeout(err) {
+		code = grpcDeadlineExceeded
+	}
+	rw.Header().Set(http.TrailerPrefix+"grpc-status", strconv.Itoa(code))
+	rw.Header().Set(http.TrailerPrefix+"grpc-message", err.Error())
+}
+
+// copyTrailers passes upstream trailers on, they are only known once the
+// body has been read completely.
+func copyTrailers(rw http.ResponseWriter, resp *http.Response) {
+	for k, values := range resp.Trailer {
+		for _, value := range values {
+			rw.Header().Add(http.TrailerPrefix+k, value)
+		}
+	}
+}
+
+// copyFlushing flushes after every chunk so that streamed messages are
+// not held back in buffers.
+func copyFlushing(rw http.ResponseWriter, body io.Reader) (int64, error) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return io.Copy(rw, body)
+	}
+	var written int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			m, werr := rw.Write(buf[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(message)))
+	copy(frame[5:], message)
+	return frame
+}
+
+// grpcHealth runs grpc.health.v1.Health/Check for the whole server. The
+// request message is empty and the response carries a single enum field.
+func grpcHealth(dst *server) bool {
+	span := tracer.Start("health-check", tracing.KindClient, tracing.SpanContext{})
+	span.SetAttribute("server.address", dst.host)
+	span.SetAttribute("rpc.method", grpcHealthMethod)
+	defer span.Finish()
+
+	status, err := checkGRPCHealth(dst, span)
+	if err != nil {
+		span.SetError(err.Error())
+		return false
+	}
+	if status != grpcServing {
+		span.SetError(fmt.Sprintf("serving status %d", status))
+		return false
+	}
+	span.SetOk()
+	return true
+}
+
+func checkGRPCHealth(dst *server, span *tracing.Span) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST",
+		fmt.Sprintf("%s://%s%s", scheme(), dst.urlHost(), grpcHealthMethod), bytes.NewReader(grpcFrame(nil)))
+	req.Header.Set("content-type", grpcContentType)
+	req.Header.Set("te", "trailers")
+	tracing.Inject(req.Header, span.Context)
+	resp, err := poolOf(dst).client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	code := resp.Trailer.Get("grpc-status")
+	if code == "" {
+		code = resp.Header.Get("grpc-status")
+	}
+	if code != strconv.Itoa(grpcOK) {
+		return 0, fmt.Errorf("health check failed with http %d, grpc-status %q", resp.StatusCode, code)
+	}
+	if len(data) < 5 || int(binary.BigEndian.Uint32(data[1:5])) != len(data)-5 {
+		return 0, fmt.Errorf("malformed health check response")
+	}
+	return decodeHealthStatus(data[5:])
+}
+
+// decodeHealthStatus reads field 1 (varint) of HealthCheckResponse.
+func decodeHealthStatus(message []byte) (int, error) {
+	status := 0
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed health check response")
+		}
+		message = message[n:]
+		if key&7 != 0 {
+			return 0, fmt.Errorf("unexpected wire type %d in health check response", key&7)
+		}
+		value, n := binary.Uvarint(message)
+		if n <= 0 {
+			return 0, fmt.Errorf("malformed health check response")
+		}
+		message = message[n:]
+		if key>>3 == 1 {
+			status = int(value)
+		}
+	}
+	return status, nil
+}
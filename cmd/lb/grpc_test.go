@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// startGRPCServer serves the standard health check and echoes any other
+// unary call, speaking the gRPC wire protocol over h2c by hand.
+func startGRPCServer(servingStatus byte) *httptest.Server {
+	return httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rw.Header().Set("content-type", grpcContentType)
+		rw.Header().Set("Trailer", "grpc-status")
+		if r.URL.Path == grpcHealthMethod {
+			_, _ = rw.Write(grpcFrame([]byte{0x08, servingStatus}))
+		} else {
+			_, _ = rw.Write(body)
+		}
+		rw.Header().Set("grpc-status", "0")
+	}), new(http2.Server)))
+}
+
+func grpcClient() *http.Client {
+	return &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+}
+
+func grpcCall(t *testing.T, url string, message []byte) *http.Response {
+	return grpcCallWithTimeout(t, url, message, "")
+}
+
+func grpcCallWithTimeout(t *testing.T, url string, message []byte, timeout string) *http.Response {
+	req, _ := http.NewRequest("POST", url+"/test.Echo/Say", bytes.NewReader(grpcFrame(message)))
+	req.Header.Set("content-type", grpcContentType)
+	req.Header.Set("te", "trailers")
+	if timeout != "" {
+		req.Header.Set("grpc-timeout", timeout)
+	}
+	resp, err := grpcClient().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestGRPCHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	serving := startGRPCServer(grpcServing)
+	defer serving.Close()
+	notServing := startGRPCServer(2)
+	defer notServing.Close()
+
+	servers := parseHosts(backendHost(serving) + "," + backendHost(notServing))
+	p := newPool("test-grpc", servers, transportConfig{H2C: true})
+	p.healthCheck = healthCheckGRPC
+
+	assert.True(checkHealth(servers[0]))
+	assert.False(checkHealth(servers[1]))
+}
+
+func TestGRPCProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := startGRPCServer(grpcServing)
+	defer backend.Close()
+	frontend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handleRequest), new(http2.Server)))
+	defer frontend.Close()
+
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(backend))
+	newPool("test-grpc-proxy", serversPool, transportConfig{H2C: true})
+
+	resp := grpcCall(t, frontend.URL, []byte("hello"))
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal(grpcFrame([]byte("hello")), body)
+	assert.Equal("0", resp.Trailer.Get("grpc-status"))
+
+	serversPool[0].isHealthy = false
+	resp = grpcCall(t, frontend.URL, []byte("hello"))
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("14", resp.Header.Get("grpc-status"))
+}
+
+func TestGRPCStreamDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", grpcContentType)
+		rw.Header().Set("Trailer", "grpc-status")
+		_, _ = rw.Write(grpcFrame([]byte("first")))
+		rw.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		rw.Header().Set("grpc-status", "0")
+	}), new(http2.Server)))
+	defer backend.Close()
+	defer close(release)
+	frontend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(handleRequest), new(http2.Server)))
+	defer frontend.Close()
+
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(backend))
+	newPool("test-grpc-deadline", serversPool, transportConfig{H2C: true})
+
+	resp := grpcCallWithTimeout(t, frontend.URL, []byte("hello"), "50m")
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(grpcFrame([]byte("first")), body)
+	assert.Equal(strconv.Itoa(grpcDeadlineExceeded), resp.Trailer.Get("grpc-status"))
+	assert.NotEmpty(resp.Trailer.Get("grpc-message"))
+}
+
+func TestGRPCTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	d, ok := grpcTimeout(&http.Request{Header: http.Header{"Grpc-Timeout": {"250m"}}})
+	assert.True(ok)
+	assert.Equal(duration(250*time.Millisecond), d)
+	d, ok = grpcTimeout(&http.Request{Header: http.Header{"Grpc-Timeout": {"3S"}}})
+	assert.True(ok)
+	assert.Equal(duration(3*time.Second), d)
+	for _, value := range []string{"", "m", "10", "10x", "123456789S", "-1S"} {
+		_, ok = grpcTimeout(&http.Request{Header: http.Header{"Grpc-Timeout": {value}}})
+		assert.False(ok, value)
+	}
+}
+
+func TestGRPCCodeFromHTTP(t *testing.T) {
+	assert.Equal(t, grpcUnimplemented, grpcCodeFromHTTP(http.StatusNotFound))
+	assert.Equal(t, grpcUnavailable, grpcCodeFromHTTP(http.StatusBadGateway))
+	assert.Equal(t, grpcUnknown, grpcCodeFromHTTP(http.StatusTeapot))
+}
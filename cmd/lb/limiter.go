@@ -0,0 +1,263 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("wait queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a free server")
+)
+
+var (
+	queueDepth       = expvar.NewInt("lb_queue_depth")
+	queueWaited      = expvar.NewInt("lb_queue_waited_total")
+	queueWaitSeconds = expvar.NewFloat("lb_queue_wait_seconds_total")
+	queueRejected    = expvar.NewMap("lb_queue_rejected_total")
+)
+
+type waiter struct {
+	candidates []*server
+	ready      chan *server
+}
+
+// limiter caps the number of in-flight requests per server, either at a
+// fixed number or at a limit learned per server once adaptive limits are
+// enabled. Requests that find every candidate busy wait in a bounded FIFO
+// queue for a release, low-priority ones are shed instead.
+type limiter struct {
+	maxInFlight  int
+	maxQueue     int
+	queueTimeout time.Duration
+
+	// adaptiveMax caps learned limits, zero disables them.
+	adaptiveMax       int
+	adaptiveTolerance float64
+
+	mux    sync.Mutex
+	queue  *list.List
+	limits map[*server]*aimdLimit
+}
+
+func newLimiter(maxInFlight, maxQueue int, queueTimeout time.Duration) *limiter {
+	return &limiter{
+		maxInFlight:  maxInFlight,
+		maxQueue:     maxQueue,
+		queueTimeout: queueTimeout,
+		queue:        list.New(),
+		limits:       make(map[*server]*aimdLimit),
+	}
+}
+
+// enableAdaptive makes the limiter learn a limit of up to max in-flight
+// requests for every server, see aimdLimit.
+func (l *limiter) enableAdaptive(max int, tolerance float64) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.adaptiveMax = max
+	l.adaptiveTolerance = tolerance
+}
+
+func (l *limiter) limitOf(s *server) *aimdLimit {
+	a, ok := l.limits[s]
+	if !ok {
+		a = newAIMDLimit(l.adaptiveMax, l.adaptiveTolerance)
+		l.limits[s] = a
+	}
+	return a
+}
+
+func (l *limiter) hasCapacity(s *server, low bool) bool {
+	limit := float64(l.maxInFlight)
+	if l.adaptiveMax > 0 {
+		if learned := l.limitOf(s).limit; limit <= 0 || learned < limit {
+			limit = learned
+		}
+	}
+	if limit <= 0 {
+		return true
+	}
+	if low {
+		limit *= lowPriorityShare
+	}
+	return float64(s.inFlight) < limit
+}
+
+func (l *limiter) available(candidates []*server, low bool) []*server {
+	var res []*server
+	for _, s := range candidates {
+		if l.hasCapacity(s, low) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// acquire picks a server among candidates and reserves an in-flight slot on
+// it. The caller must release the server once the request is done.
+func (l *limiter) acquire(ctx context.Context, candidates []*server) (*server, error) {
+	low := isLowPriority(ctx)
+	l.mux.Lock()
+	candidates = preferZone(activeTiers(candidates))
+	dst, err := balanceStrategy(l.available(candidates, low))
+	if err == nil {
+		dst.inFlight++
+		l.mux.Unlock()
+		countSpillover(dst)
+		return dst, nil
+	}
+	if _, err := balanceStrategy(candidates); err != nil {
+		l.mux.Unlock()
+		return nil, err
+	}
+	if low {
+		l.mux.Unlock()
+		shedRequests.Add(1)
+		return nil, errShed
+	}
+	if l.queue.Len() >= l.maxQueue {
+		l.mux.Unlock()
+		queueRejected.Add("full", 1)
+		return nil, errQueueFull
+	}
+	w := &waiter{candidates: candidates, ready: make(chan *server, 1)}
+	elem := l.queue.PushBack(w)
+	queueDepth.Set(int64(l.queue.Len()))
+	l.mux.Unlock()
+
+	start := time.Now()
+	defer func() {
+		queueWaited.Add(1)
+		queueWaitSeconds.Add(time.Since(start).Seconds())
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	reason := "timeout"
+	select {
+	case dst := <-w.ready:
+		countSpillover(dst)
+		return dst, nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+		reason = "canceled"
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	select {
+	case dst := <-w.ready:
+		// A server was handed over while we were giving up.
+		countSpillover(dst)
+		return dst, nil
+	default:
+	}
+	l.queue.Remove(elem)
+	queueDepth.Set(int64(l.queue.Len()))
+	queueRejected.Add(reason, 1)
+	return nil, err
+}
+
+// release frees the slot on s, passing it straight to the oldest waiter
+// that can use it.
+func (l *limiter) release(s *server) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	s.inFlight--
+	if !s.available() || !l.hasCapacity(s, false) {
+		return
+	}
+	for elem := l.queue.Front(); elem != nil; elem = elem.Next() {
+		w := elem.Value.(*waiter)
+		if contains(w.candidates, s) {
+			s.inFlight++
+			l.queue.Remove(elem)
+			queueDepth.Set(int64(l.queue.Len()))
+			w.ready <- s
+			return
+		}
+	}
+}
+
+// observe feeds the latency of a response, or the timeout that replaced
+// it, into the learned limit of s.
+func (l *limiter) observe(s *server, latency time.Duration, err error) {
+	if err != nil && !isTimeout(err) {
+		return
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.adaptiveMax > 0 {
+		l.limitOf(s).observe(latency, err != nil)
+	}
+}
+
+// addTraffic counts n more bytes sent through s.
+func (l *limiter) addTraffic(s *server, n int) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	s.traffic += n
+}
+
+// keepsPin reports whether a client pinned to s may stay there: s takes
+// new requests and is among the servers of candidates acquire would pick
+// from, so pinned clients go back to the first tier and to the local zone
+// once they recover.
+func (l *limiter) keepsPin(s *server, candidates []*server) bool {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if !s.available() {
+		return false
+	}
+	for _, c := range preferZone(activeTiers(candidates)) {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
+
+// learnedLimits returns the current limit of every server that has one.
+func (l *limiter) learnedLimits() map[string]float64 {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	res := make(map[string]float64)
+	for s, a := range l.limits {
+		res[s.host] = math.Round(a.limit*100) / 100
+	}
+	return res
+}
+
+// inFlight returns the number of in-flight requests of every server by
+// pool.
+func (l *limiter) inFlight() map[string]map[string]int {
+	servers := allServers()
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	res := make(map[string]map[string]int)
+	for _, s := range servers {
+		name := poolOf(s).name
+		if res[name] == nil {
+			res[name] = make(map[string]int)
+		}
+		res[name][s.host] = s.inFlight
+	}
+	return res
+}
+
+func contains(servers []*server, s *server) bool {
+	for _, candidate := range servers {
+		if candidate == s {
+			return true
+		}
+	}
+	return false
+}
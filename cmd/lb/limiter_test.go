@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	servers := []*server{
+		{host: "server1:8080", isHealthy: true},
+	}
+	l := newLimiter(1, 1, time.Second)
+
+	first, err := l.acquire(context.Background(), servers)
+	assert.Nil(err)
+	assert.Equal(1, first.inFlight)
+
+	result := make(chan *server)
+	go func() {
+		s, err := l.acquire(context.Background(), servers)
+		assert.Nil(err)
+		result <- s
+	}()
+	for queued := 0; queued == 0; {
+		time.Sleep(time.Millisecond)
+		l.mux.Lock()
+		queued = l.queue.Len()
+		l.mux.Unlock()
+	}
+
+	_, err = l.acquire(context.Background(), servers)
+	assert.Equal(errQueueFull, err)
+
+	l.release(first)
+	assert.Equal(servers[0], <-result)
+	assert.Equal(1, servers[0].inFlight)
+	assert.Equal(0, l.queue.Len())
+}
+
+func TestLimiterQueueTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	servers := []*server{
+		{host: "server1:8080", isHealthy: true, inFlight: 1},
+		{host: "server2:8080", isHealthy: false},
+	}
+	l := newLimiter(1, 10, 10*time.Millisecond)
+
+	_, err := l.acquire(context.Background(), servers)
+	assert.Equal(errQueueTimeout, err)
+	assert.Equal(0, l.queue.Len())
+
+	servers[0].isHealthy = false
+	_, err = l.acquire(context.Background(), servers)
+	assert.NotNil(err)
+	assert.NotEqual(errQueueTimeout, err)
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, "1", retryAfter(10*time.Millisecond))
+	assert.Equal(t, "3", retryAfter(2500*time.Millisecond))
+}
+
+func TestLimiterInFlightByPool(t *testing.T) {
+	defer func() {
+		poolsMux.Lock()
+		delete(pools, "counted")
+		poolsMux.Unlock()
+	}()
+	servers := setupPool("counted", nil, poolConfig{Servers: []string{"counted:8080"}})
+	l := newLimiter(0, 0, 0)
+	dst, err := l.acquire(context.Background(), servers)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"counted:8080": 1}, l.inFlight()["counted"])
+	l.release(dst)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
+	"github.com/stretchr/testify/assert"
+)
+
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func TestUnixSocketServers(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "backend.sock")
+
+	l, err := httptools.Listen("unix:" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.Host + " " + r.URL.Path))
+	})}
+	go func() { _ = backend.Serve(l) }()
+	defer backend.Close()
+
+	servers := parseHosts("unix:" + socket)
+	newPool("test-unix", servers, transportConfig{})
+	assert.Equal("localhost /api/v1/some-data", forwardTo(servers[0], "/api/v1/some-data").Body.String())
+	assert.True(health(servers[0]))
+	assert.True(tcpHealth(servers[0]))
+
+	_, err = httptools.Listen("unix:" + socket)
+	assert.NotNil(err, "sockets in use are not taken over")
+}
+
+func TestMultipleListeners(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-listeners")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "lb.sock")
+	// A socket file left behind by a crashed balancer does not block us.
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	specs := []string{"127.0.0.1:0", "unix:" + socket}
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+		specs = append(specs, "[::1]:0")
+	}
+	listeners, err := httptools.ListenAll(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherited, err := listeners[0].(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	// Listen owns the descriptor it is given, so it gets a copy.
+	fd, err := syscall.Dup(int(inherited.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromFd, err := httptools.Listen("fd:" + strconv.Itoa(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Listeners stay open, the server exits the process once they close.
+	listeners = append(listeners, fromFd)
+
+	httptools.CreateServerOn(listeners, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}), "", "").Start()
+
+	client := &http.Client{Timeout: time.Second}
+	for _, l := range listeners {
+		c := client
+		url := "http://" + l.Addr().String() + "/"
+		if l.Addr().Network() == "unix" {
+			c, url = unixClient(socket), "http://lb/"
+		}
+		resp, err := c.Get(url)
+		if assert.Nil(err, l.Addr().String()) {
+			resp.Body.Close()
+			assert.Equal(http.StatusOK, resp.StatusCode)
+		}
+	}
+
+	_, err = httptools.ListenAll([]string{"127.0.0.1:0", "fd:x"})
+	assert.NotNil(err)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"expvar"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	shadowHeader     = "X-Shadow-Request"
+	maxMirroredBody  = 1 << 20
+	mirrorResultWait = 30 * time.Second
+)
+
+var (
+	mirrorRequests = expvar.NewInt("lb_mirror_requests_total")
+	mirrorSkipped  = expvar.NewInt("lb_mirror_skipped_total")
+	mirrorErrors   = expvar.NewInt("lb_mirror_errors_total")
+	mirrorDiffs    = expvar.NewInt("lb_mirror_diffs_total")
+)
+
+var (
+	shadowPool []*server
+	// mirrorsInFlight counts mirrored requests holding a body or waiting
+	// for the shadow pool.
+	mirrorsInFlight int64
+)
+
+type mirrorResult struct {
+	status int
+	digest string
+	err    error
+}
+
+// mirrorRecorder fingerprints the primary response so that it can be
+// compared with the shadow one without keeping the body around.
+type mirrorRecorder struct {
+	*statusRecorder
+	hash hash.Hash
+}
+
+func (rec *mirrorRecorder) Write(data []byte) (int, error) {
+	rec.hash.Write(data)
+	return rec.statusRecorder.Write(data)
+}
+
+func (rec *mirrorRecorder) result() mirrorResult {
+	return mirrorResult{status: rec.status, digest: fmt.Sprintf("%x", rec.hash.Sum(nil))}
+}
+
+func parseHosts(list string) []*server {
+	return serversFromHosts(strings.Split(list, ","))
+}
+
+func serversFromHosts(hosts []string) []*server {
+	var res []*server
+	for _, host := range hosts {
+		if host = strings.TrimSpace(host); host != "" {
+			res = append(res, &server{host: host, isHealthy: true})
+		}
+	}
+	return res
+}
+
+func shouldMirror(r *http.Request, percent float64) bool {
+	if len(shadowPool) == 0 || percent <= 0 || r.ContentLength > maxMirroredBody {
+		return false
+	}
+	return rand.Float64()*100 < percent
+}
+
+// mirrorBody passes the request body on to the primary and keeps a copy
+// for the shadow. The copy is given up when it grows past maxMirroredBody
+// or the body is closed before it is read to the end.
+type mirrorBody struct {
+	io.ReadCloser
+	done chan []byte
+
+	mux      sync.Mutex
+	buf      bytes.Buffer
+	overflow bool
+	once     sync.Once
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mux.Lock()
+	if !b.overflow {
+		if b.buf.Len()+n > maxMirroredBody {
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	b.mux.Unlock()
+	if err == io.EOF {
+		b.finish(true)
+	}
+	return n, err
+}
+
+func (b *mirrorBody) Close() error {
+	b.finish(false)
+	return b.ReadCloser.Close()
+}
+
+func (b *mirrorBody) finish(complete bool) {
+	b.once.Do(func() {
+		b.mux.Lock()
+		defer b.mux.Unlock()
+		if complete && !b.overflow {
+			b.done <- b.buf.Bytes()
+		}
+		close(b.done)
+	})
+}
+
+// startMirror copies the request to the shadow pool in the background once
+// the primary has read its body. The returned channel takes the primary
+// result for comparison; sending to it never blocks. It is nil when too
+// many requests are being mirrored already.
+func startMirror(r *http.Request, info *requestInfo, limit int) chan<- mirrorResult {
+	if atomic.AddInt64(&mirrorsInFlight, 1) > int64(limit) {
+		atomic.AddInt64(&mirrorsInFlight, -1)
+		mirrorSkipped.Add(1)
+		return nil
+	}
+	bodies := make(chan []byte, 1)
+	if r.Body == nil || r.Body == http.NoBody {
+		bodies <- nil
+		close(bodies)
+	} else {
+		r.Body = &mirrorBody{ReadCloser: r.Body, done: bodies}
+	}
+	primary := make(chan mirrorResult, 1)
+	shadowRequest := r.Clone(context.Background())
+	go func() {
+		defer atomic.AddInt64(&mirrorsInFlight, -1)
+		mirror(shadowRequest, bodies, info.id, primary)
+	}()
+	return primary
+}
+
+func mirror(r *http.Request, bodies <-chan []byte, id string, primary <-chan mirrorResult) {
+	var res *mirrorResult
+	var body []byte
+	var ok bool
+	select {
+	case body, ok = <-bodies:
+	case primaryRes := <-primary:
+		// The primary is done, its body was either read by now or never
+		// will be.
+		res = &primaryRes
+		select {
+		case body, ok = <-bodies:
+		default:
+		}
+	}
+	if !ok {
+		mirrorSkipped.Add(1)
+		return
+	}
+
+	mirrorRequests.Add(1)
+	shadow := sendShadow(r, body)
+	if shadow.err != nil {
+		mirrorErrors.Add(1)
+		log.Printf("mirror %s %s: shadow failed: %s", id, r.URL.Path, shadow.err)
+		return
+	}
+
+	if res == nil {
+		select {
+		case primaryRes := <-primary:
+			res = &primaryRes
+		case <-time.After(mirrorResultWait):
+			return
+		}
+	}
+	if res.status != shadow.status || res.digest != shadow.digest {
+		mirrorDiffs.Add(1)
+		log.Printf("mirror %s %s: primary %d %s, shadow %d %s",
+			id, r.URL.Path, res.status, res.digest, shadow.status, shadow.digest)
+	}
+}
+
+func sendShadow(r *http.Request, body []byte) mirrorResult {
+	backendLimiter.mux.Lock()
+	dst, err := balanceStrategy(shadowPool)
+	backendLimiter.mux.Unlock()
+	if err != nil {
+		return mirrorResult{err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+	r.RequestURI = ""
+	r.URL.Host = dst.urlHost()
+	r.URL.Scheme = scheme()
+	r.Host = dst.hostHeader()
+	r.Header.Set(shadowHeader, "1")
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+
+	resp, err := poolOf(dst).client.Do(r)
+	if err != nil {
+		return mirrorResult{err: err}
+	}
+	defer resp.Body.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, resp.Body)
+	if err != nil {
+		return mirrorResult{err: err}
+	}
+	backendLimiter.addTraffic(dst, int(n))
+	return mirrorResult{status: resp.StatusCode, digest: fmt.Sprintf("%x", h.Sum(nil))}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMirror(t *testing.T) {
+	assert := assert.New(t)
+
+	shadowBodies := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		assert.Equal("1", r.Header.Get(shadowHeader))
+		time.Sleep(20 * time.Millisecond)
+		_, _ = rw.Write([]byte("shadow"))
+		shadowBodies <- string(body)
+	}))
+	defer shadow.Close()
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = rw.Write(body)
+	}))
+	defer primary.Close()
+
+	defer func(old, oldShadow []*server, oldPercent float64) {
+		serversPool, shadowPool, *shadowPercent = old, oldShadow, oldPercent
+	}(serversPool, shadowPool, *shadowPercent)
+	serversPool = parseHosts(backendHost(primary))
+	shadowPool = parseHosts(backendHost(shadow))
+	*shadowPercent = 100
+
+	diffs := mirrorDiffs.Value()
+	rw := httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("POST", "/api/v1/some-data", strings.NewReader("payload")))
+
+	assert.Equal("payload", rw.Body.String())
+	assert.Equal("payload", <-shadowBodies)
+	for i := 0; i < 100 && mirrorDiffs.Value() == diffs; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(diffs+1, mirrorDiffs.Value())
+}
+
+func TestMirrorStreamsBody(t *testing.T) {
+	assert := assert.New(t)
+
+	shadowBodies := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		shadowBodies <- string(body)
+	}))
+	defer shadow.Close()
+	primary := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(ioutil.Discard, r.Body)
+		_, _ = fmt.Fprint(rw, n)
+	}))
+	defer primary.Close()
+
+	defer func(old, oldShadow []*server, oldPercent float64) {
+		serversPool, shadowPool, *shadowPercent = old, oldShadow, oldPercent
+	}(serversPool, shadowPool, *shadowPercent)
+	serversPool = parseHosts(backendHost(primary))
+	shadowPool = parseHosts(backendHost(shadow))
+	*shadowPercent = 100
+
+	// Bodies of unknown length reach the primary as they are.
+	send := func(body string) string {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1/some-data", ioutil.NopCloser(strings.NewReader(body)))
+		assert.Equal(int64(-1), r.ContentLength)
+		handleRequest(rw, r)
+		return rw.Body.String()
+	}
+	assert.Equal("7", send("payload"))
+	assert.Equal("payload", <-shadowBodies)
+
+	skipped := mirrorSkipped.Value()
+	large := strings.Repeat("a", 3*maxMirroredBody)
+	assert.Equal(strconv.Itoa(len(large)), send(large))
+	assert.True(eventually(func() bool {
+		return mirrorSkipped.Value() == skipped+1
+	}), "bodies too large to mirror are only sent to the primary")
+	select {
+	case body := <-shadowBodies:
+		t.Errorf("shadow got %d bytes", len(body))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Past the limit of mirrored requests only the primary gets them.
+	defer func(old int) { *shadowLimit = old }(*shadowLimit)
+	*shadowLimit = 0
+	skipped = mirrorSkipped.Value()
+	assert.Equal("7", send("payload"))
+	assert.Equal(skipped+1, mirrorSkipped.Value())
+	select {
+	case body := <-shadowBodies:
+		t.Errorf("shadow got %q", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestParseHosts(t *testing.T) {
+	servers := parseHosts(" shadow1:8080,,shadow2:8080 ")
+	assert.Len(t, servers, 2)
+	assert.Equal(t, "shadow2:8080", servers[1].host)
+	assert.Empty(t, parseHosts(""))
+}
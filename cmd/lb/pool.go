@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	stablePoolName = "stable"
+	canaryPoolName = "canary"
+	shadowPoolName = "shadow"
+
+	healthCheckHTTP = "http"
+	healthCheckTCP  = "tcp"
+	healthCheckGRPC = "grpc"
+
+	// unixHostPrefix marks servers listening on a Unix socket, such as
+	// unix:/run/app.sock.
+	unixHostPrefix = "unix:"
+	unixURLSuffix  = ".unix-socket"
+)
+
+// transportConfig tunes the connections a pool keeps to its servers.
+type transportConfig struct {
+	MaxIdleConns        int      `json:"maxIdleConns,omitempty"`
+	MaxIdleConnsPerHost int      `json:"maxIdleConnsPerHost,omitempty"`
+	MaxConnsPerHost     int      `json:"maxConnsPerHost,omitempty"`
+	IdleConnTimeout     duration `json:"idleConnTimeout,omitempty"`
+	KeepAlive           duration `json:"keepAlive,omitempty"`
+	DisableKeepAlives   bool     `json:"disableKeepAlives,omitempty"`
+	// LocalAddr is the source address to dial servers from.
+	LocalAddr string `json:"localAddr,omitempty"`
+	// HTTP2 negotiates HTTP/2 over TLS, H2C speaks cleartext HTTP/2
+	// with prior knowledge over a single connection per server, which
+	// leaves the connection limits and idle timeouts nothing to tune.
+	HTTP2 bool `json:"http2,omitempty"`
+	H2C   bool `json:"h2c,omitempty"`
+}
+
+func (tc transportConfig) validate() error {
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 {
+		return errors.New("connection limits must not be negative")
+	}
+	if tc.IdleConnTimeout < 0 || tc.KeepAlive < 0 {
+		return errors.New("transport timeouts must not be negative")
+	}
+	if tc.H2C && (tc.MaxIdleConns != 0 || tc.MaxIdleConnsPerHost != 0 || tc.MaxConnsPerHost != 0 ||
+		tc.IdleConnTimeout != 0 || tc.DisableKeepAlives) {
+		return errors.New("h2c does not support connection limits, idleConnTimeout or disableKeepAlives")
+	}
+	if tc.LocalAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(tc.LocalAddr, "0")); err != nil {
+			return fmt.Errorf("bad localAddr: %s", err)
+		}
+	}
+	return nil
+}
+
+type poolConfig struct {
+	Servers   []string        `json:"servers"`
+	Transport transportConfig `json:"transport"`
+	// HealthCheck is http, tcp or grpc, by default it follows -mode.
+	HealthCheck string `json:"healthCheck,omitempty"`
+	// Tiers are groups of servers that only take requests when the ones
+	// before them, Servers first, are short of healthy servers. Backups
+	// make up the last tier.
+	Tiers   [][]string `json:"tiers,omitempty"`
+	Backups []string   `json:"backups,omitempty"`
+	// MinHealthy is the share of a tier's servers that must be healthy
+	// for it to take requests alone. By default one is enough.
+	MinHealthy float64 `json:"minHealthy,omitempty"`
+	// Zones maps servers to the zones they run in.
+	Zones map[string]string `json:"zones,omitempty"`
+}
+
+func (pc poolConfig) validate() error {
+	switch pc.HealthCheck {
+	case "", healthCheckHTTP, healthCheckTCP, healthCheckGRPC:
+	default:
+		return fmt.Errorf("unknown health check %q", pc.HealthCheck)
+	}
+	if pc.MinHealthy < 0 || pc.MinHealthy > 1 {
+		return fmt.Errorf("minHealthy must be within [0, 1], got %v", pc.MinHealthy)
+	}
+	return pc.Transport.validate()
+}
+
+type poolStats struct {
+	Dials       int64 `json:"dials"`
+	DialErrors  int64 `json:"dialErrors"`
+	OpenConns   int64 `json:"openConns"`
+	NewConns    int64 `json:"newConns"`
+	ReusedConns int64 `json:"reusedConns"`
+}
+
+// pool is a group of servers sharing one upstream transport.
+type pool struct {
+	name        string
+	servers     []*server
+	config      transportConfig
+	healthCheck string
+	minHealthy  float64
+	client      *http.Client
+	stats       poolStats
+}
+
+var (
+	poolsMux sync.Mutex
+	pools    = make(map[string]*pool)
+
+	defaultPool = newPool("default", nil, transportConfig{})
+)
+
+func init() {
+	expvar.Publish("lb_pools", expvar.Func(func() interface{} {
+		poolsMux.Lock()
+		defer poolsMux.Unlock()
+		res := make(map[string]poolStats)
+		for name, p := range pools {
+			res[name] = p.snapshot()
+		}
+		return res
+	}))
+}
+
+func newPool(name string, servers []*server, tc transportConfig) *pool {
+	p := &pool{name: name, servers: servers, config: tc}
+	p.client = &http.Client{Transport: p.newTransport()}
+	for _, s := range servers {
+		s.pool = p
+	}
+	return p
+}
+
+func registerPool(p *pool) {
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	pools[p.name] = p
+}
+
+// poolServers returns the servers of the pool called name.
+func poolServers(name string) []*server {
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	if p, ok := pools[name]; ok {
+		return p.servers
+	}
+	return nil
+}
+
+func poolRegistered(name string) bool {
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	_, ok := pools[name]
+	return ok
+}
+
+// routedPools lists the pools other than stable, canary and shadow, which
+// only get requests of the routes naming them.
+func routedPools() []*pool {
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	var res []*pool
+	for name, p := range pools {
+		if name != stablePoolName && name != canaryPoolName && name != shadowPoolName {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// setupPools creates the stable, canary and shadow pools, taking servers
+// from the config when it lists them and from flags otherwise, plus every
+// other pool the config defines. Pools are only read at startup.
+func setupPools(cfg map[string]poolConfig) {
+	serversPool = setupPool(stablePoolName, serversPool, cfg[stablePoolName])
+	canaryPool = setupPool(canaryPoolName, canaryPool, cfg[canaryPoolName])
+	shadowPool = setupPool(shadowPoolName, shadowPool, cfg[shadowPoolName])
+	for name, pc := range cfg {
+		if name != stablePoolName && name != canaryPoolName && name != shadowPoolName {
+			setupPool(name, nil, pc)
+		}
+	}
+}
+
+func setupPool(name string, servers []*server, pc poolConfig) []*server {
+	if len(pc.Servers) > 0 {
+		servers = serversFromHosts(pc.Servers)
+	}
+	tiers := append(append([][]string(nil), pc.Tiers...), pc.Backups)
+	for i, hosts := range tiers {
+		for _, s := range serversFromHosts(hosts) {
+			s.tier = i + 1
+			servers = append(servers, s)
+		}
+	}
+	for _, s := range servers {
+		if zone, ok := pc.Zones[s.host]; ok {
+			s.zone = zone
+		}
+	}
+	p := newPool(name, servers, pc.Transport)
+	p.healthCheck = pc.HealthCheck
+	p.minHealthy = pc.MinHealthy
+	registerPool(p)
+	return servers
+}
+
+func (p *pool) newTransport() http.RoundTripper {
+	tc := p.config
+	if tc.H2C {
+		t := &http2.Transport{AllowHTTP: true}
+		t.ConnPool = &h2cConnPool{pool: p, transport: t, conns: make(map[string]*http2.ClientConn)}
+		return t
+	}
+	t := &http.Transport{
+		Proxy:               proxyFromEnvironment,
+		DialContext:         p.dial,
+		DialTLSContext:      p.dialTLS,
+		ForceAttemptHTTP2:   tc.HTTP2,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     tc.MaxConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		DisableKeepAlives:   tc.DisableKeepAlives,
+	}
+	if tc.MaxIdleConns > 0 {
+		t.MaxIdleConns = tc.MaxIdleConns
+	}
+	if tc.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = time.Duration(tc.IdleConnTimeout)
+	}
+	return t
+}
+
+// h2cConnPool keeps one cleartext HTTP/2 connection per server. The
+// transport dials without a context, so connections are dialled here with
+// the one of the request that needs them, which carries its dial timeout.
+type h2cConnPool struct {
+	pool      *pool
+	transport *http2.Transport
+
+	mux   sync.Mutex
+	conns map[string]*http2.ClientConn
+}
+
+func (cp *h2cConnPool) GetClientConn(r *http.Request, addr string) (*http2.ClientConn, error) {
+	if cc := cp.usable(addr); cc != nil {
+		return cc, nil
+	}
+	conn, err := cp.pool.dial(r.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := cp.transport.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	// Another request may have dialled the server meanwhile.
+	if current := cp.conns[addr]; current != nil && current.CanTakeNewRequest() {
+		cc.Close()
+		return current, nil
+	}
+	cp.conns[addr] = cc
+	return cc, nil
+}
+
+func (cp *h2cConnPool) usable(addr string) *http2.ClientConn {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	if cc := cp.conns[addr]; cc != nil && cc.CanTakeNewRequest() {
+		return cc
+	}
+	return nil
+}
+
+func (cp *h2cConnPool) MarkDead(cc *http2.ClientConn) {
+	cp.mux.Lock()
+	defer cp.mux.Unlock()
+	for addr, current := range cp.conns {
+		if current == cc {
+			delete(cp.conns, addr)
+		}
+	}
+}
+
+// proxyFromEnvironment never sends requests for Unix socket servers to
+// an HTTP proxy.
+func proxyFromEnvironment(r *http.Request) (*url.URL, error) {
+	if strings.HasSuffix(r.URL.Hostname(), unixURLSuffix) {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(r)
+}
+
+// dial applies the dial timeout of the request being served and the
+// pool's dial options.
+func (p *pool) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout:   time.Duration(timeoutsFrom(ctx).Dial),
+		KeepAlive: 30 * time.Second,
+	}
+	if p.config.KeepAlive > 0 {
+		d.KeepAlive = time.Duration(p.config.KeepAlive)
+	}
+	if path, ok := unixSocketPath(addr); ok {
+		network, addr = "unix", path
+	} else if p.config.LocalAddr != "" {
+		d.LocalAddr, _ = net.ResolveTCPAddr("tcp", net.JoinHostPort(p.config.LocalAddr, "0"))
+	}
+	atomic.AddInt64(&p.stats.Dials, 1)
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		atomic.AddInt64(&p.stats.DialErrors, 1)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, &timeoutError{phase: "dial", err: err}
+		}
+		return nil, err
+	}
+	atomic.AddInt64(&p.stats.OpenConns, 1)
+	return &countedConn{Conn: conn, open: &p.stats.OpenConns}, nil
+}
+
+func (p *pool) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if _, ok := unixSocketPath(addr); ok {
+		host = "localhost"
+	}
+	cfg := &tls.Config{ServerName: host}
+	if p.config.HTTP2 {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if t := timeoutsFrom(ctx).TLSHandshake; t > 0 {
+		_ = conn.SetDeadline(time.Now().Add(time.Duration(t)))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, &timeoutError{phase: "tls handshake", err: err}
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// trace counts whether requests got a fresh or a reused connection.
+func (p *pool) trace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				atomic.AddInt64(&p.stats.ReusedConns, 1)
+			} else {
+				atomic.AddInt64(&p.stats.NewConns, 1)
+			}
+		},
+	})
+}
+
+func (p *pool) snapshot() poolStats {
+	return poolStats{
+		Dials:       atomic.LoadInt64(&p.stats.Dials),
+		DialErrors:  atomic.LoadInt64(&p.stats.DialErrors),
+		OpenConns:   atomic.LoadInt64(&p.stats.OpenConns),
+		NewConns:    atomic.LoadInt64(&p.stats.NewConns),
+		ReusedConns: atomic.LoadInt64(&p.stats.ReusedConns),
+	}
+}
+
+// allServers lists the servers of every pool, stable ones first.
+func allServers() []*server {
+	res := append(append(append([]*server(nil), serversPool...), canaryPool...), shadowPool...)
+	poolsMux.Lock()
+	defer poolsMux.Unlock()
+	for _, p := range pools {
+		for _, s := range p.servers {
+			if !contains(res, s) {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+func findServer(host string) *server {
+	for _, s := range allServers() {
+		if s.host == host {
+			return s
+		}
+	}
+	return nil
+}
+
+// urlHost is the host of URLs to s. A socket path cannot be one, so it is
+// hex-encoded into a name that dial maps back to the path.
+func (s *server) urlHost() string {
+	if strings.HasPrefix(s.host, unixHostPrefix) {
+		return hex.EncodeToString([]byte(strings.TrimPrefix(s.host, unixHostPrefix))) + unixURLSuffix
+	}
+	return s.host
+}
+
+// hostHeader is the Host requests to s carry.
+func (s *server) hostHeader() string {
+	if strings.HasPrefix(s.host, unixHostPrefix) {
+		return "localhost"
+	}
+	return s.host
+}
+
+// unixSocketPath recognizes both unix:/path addresses and the ones
+// urlHost makes up.
+func unixSocketPath(addr string) (string, bool) {
+	if strings.HasPrefix(addr, unixHostPrefix) {
+		return strings.TrimPrefix(addr, unixHostPrefix), true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !strings.HasSuffix(addr, unixURLSuffix) {
+		return "", false
+	}
+	path, err := hex.DecodeString(strings.TrimSuffix(addr, unixURLSuffix))
+	if err != nil {
+		return "", false
+	}
+	return string(path), true
+}
+
+func poolOf(s *server) *pool {
+	if s.pool == nil {
+		return defaultPool
+	}
+	return s.pool
+}
+
+type countedConn struct {
+	net.Conn
+	open   *int64
+	closed int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(c.open, -1)
+	}
+	return c.Conn.Close()
+}
+
+func (c *countedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
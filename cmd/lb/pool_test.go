@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func forwardTo(dst *server, path string) *httptest.ResponseRecorder {
+	info := &requestInfo{
+		span:     tracer.Start("test", tracing.KindInternal, tracing.SpanContext{}),
+		timeouts: defaultTimeouts,
+	}
+	rw := httptest.NewRecorder()
+	_ = forward(dst, rw, httptest.NewRequest("GET", path, nil), info)
+	return rw
+}
+
+func TestPoolConnectionReuse(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.Proto))
+	}))
+	defer backend.Close()
+
+	servers := parseHosts(backendHost(backend))
+	p := newPool("test", servers, transportConfig{MaxIdleConnsPerHost: 4})
+	for i := 0; i < 3; i++ {
+		assert.Equal("HTTP/1.1", forwardTo(servers[0], "/").Body.String())
+	}
+
+	stats := p.snapshot()
+	assert.Equal(int64(1), stats.Dials)
+	assert.Equal(int64(1), stats.NewConns)
+	assert.Equal(int64(2), stats.ReusedConns)
+	assert.Equal(int64(1), stats.OpenConns)
+}
+
+func TestPoolH2C(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte(r.Proto))
+	}), new(http2.Server)))
+	defer backend.Close()
+
+	servers := parseHosts(backendHost(backend))
+	p := newPool("test-h2c", servers, transportConfig{H2C: true})
+	assert.Equal("HTTP/2.0", forwardTo(servers[0], "/").Body.String())
+	assert.Equal("HTTP/2.0", forwardTo(servers[0], "/").Body.String())
+	assert.Equal(int64(1), p.snapshot().Dials)
+
+	// New connections are dialled with the context of the request.
+	p = newPool("test-h2c-canceled", parseHosts(backendHost(backend)), transportConfig{H2C: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, _ := http.NewRequestWithContext(ctx, "GET", backend.URL, nil)
+	_, err := p.client.Do(r)
+	assert.True(errors.Is(err, context.Canceled), "%v", err)
+	assert.Equal(int64(1), p.snapshot().DialErrors)
+}
+
+func TestSetupPools(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(old, oldCanary, oldShadow []*server) {
+		serversPool, canaryPool, shadowPool = old, oldCanary, oldShadow
+	}(serversPool, canaryPool, shadowPool)
+	canaryPool = parseHosts("canary1:8080")
+
+	setupPools(map[string]poolConfig{
+		stablePoolName: {Servers: []string{"a:8080", "b:8080"}},
+		"db":           {Servers: []string{"db:8080"}},
+	})
+	assert.Len(serversPool, 2)
+	assert.Equal(stablePoolName, serversPool[0].pool.name)
+	assert.Equal("canary1:8080", canaryPool[0].host)
+	assert.Equal("db:8080", pools["db"].servers[0].host)
+
+	assert.NotNil(transportConfig{MaxConnsPerHost: -1}.validate())
+	assert.NotNil(transportConfig{LocalAddr: "not an address"}.validate())
+	assert.Nil(transportConfig{H2C: true, KeepAlive: duration(time.Second)}.validate())
+	assert.NotNil(transportConfig{H2C: true, MaxConnsPerHost: 4}.validate())
+	assert.NotNil(transportConfig{H2C: true, IdleConnTimeout: duration(time.Minute)}.validate())
+	assert.NotNil(transportConfig{H2C: true, DisableKeepAlives: true}.validate())
+}
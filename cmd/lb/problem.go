@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	problemContentType = "application/problem+json"
+
+	// statusClientClosedRequest is what nginx logs when the client goes
+	// away before the response is ready; it never reaches the client.
+	statusClientClosedRequest = 499
+)
+
+// problem is an RFC 7807 error description.
+type problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// errorPage replaces the problem body for one status on a route.
+type errorPage struct {
+	contentType string
+	body        []byte
+}
+
+func loadErrorPage(path string) (errorPage, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errorPage{}, err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(path))
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	return errorPage{contentType: contentType, body: body}, nil
+}
+
+// failureStatus tells apart a client that went away, an exchange that
+// took too long, a balancer with nowhere to send the request and a
+// server that could not be talked to.
+func failureStatus(r *http.Request, err error) int {
+	switch {
+	case r.Context().Err() != nil:
+		return statusClientClosedRequest
+	case isTimeout(err):
+		return http.StatusGatewayTimeout
+	case err == errNoHealthyServers || isOverload(err):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// isOverload tells whether err means every server is at its limit.
+func isOverload(err error) bool {
+	return err == errQueueFull || err == errQueueTimeout || err == errShed
+}
+
+func problemTitle(status int) string {
+	if status == statusClientClosedRequest {
+		return "Client Closed Request"
+	}
+	return http.StatusText(status)
+}
+
+func problemDetail(status int, err error) string {
+	switch status {
+	case http.StatusGatewayTimeout:
+		return fmt.Sprintf("The upstream server did not answer in time: %s.", err)
+	case http.StatusServiceUnavailable:
+		return fmt.Sprintf("No upstream server can take the request: %s.", err)
+	case http.StatusBadGateway:
+		return "The upstream server could not be reached or sent an invalid response."
+	}
+	return ""
+}
+
+// writeFailure answers a request that could not be proxied. gRPC clients
+// get a trailers-only response, everyone else the route's error page for
+// the status or a problem+json body.
+func writeFailure(rw http.ResponseWriter, r *http.Request, info *requestInfo, err error) {
+	status := failureStatus(r, err)
+	if isGRPC(r) {
+		code := grpcUnavailable
+		switch {
+		case status == statusClientClosedRequest:
+			code = grpcCancelled
+		case status == http.StatusGatewayTimeout:
+			code = grpcDeadlineExceeded
+		case isOverload(err):
+			code = grpcResourceExhausted
+		}
+		writeGRPCError(rw, code, err.Error())
+		return
+	}
+
+	writeProblem(rw, r, info, status, problemDetail(status, err))
+}
+
+// writeProblem answers with the route's error page for status or a
+// problem+json body.
+func writeProblem(rw http.ResponseWriter, r *http.Request, info *requestInfo, status int, detail string) {
+	if page, ok := info.route.pages[status]; ok {
+		rw.Header().Set("Content-Type", page.contentType)
+		rw.Header().Set("Content-Length", strconv.Itoa(len(page.body)))
+		rw.WriteHeader(status)
+		_, _ = rw.Write(page.body)
+		return
+	}
+	data, _ := json.Marshal(problem{
+		Type:      "about:blank",
+		Title:     problemTitle(status),
+		Status:    status,
+		Detail:    detail,
+		Instance:  r.URL.Path,
+		RequestID: info.id,
+	})
+	rw.Header().Set("Content-Type", problemContentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rw.WriteHeader(status)
+	_, _ = rw.Write(data)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailureResponses(t *testing.T) {
+	assert := assert.New(t)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	defer func(old []*server, oldRetries int) { serversPool, *retries = old, oldRetries }(serversPool, *retries)
+	*retries = 0
+
+	serversPool = parseHosts(backendHost(down))
+	rw := httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+	assert.Equal(http.StatusBadGateway, rw.Code)
+	assert.Equal(problemContentType, rw.Header().Get("Content-Type"))
+	var p problem
+	assert.Nil(json.Unmarshal(rw.Body.Bytes(), &p))
+	assert.Equal(http.StatusBadGateway, p.Status)
+	assert.Equal("Bad Gateway", p.Title)
+	assert.Equal("/api/v1/some-data", p.Instance)
+	assert.NotEmpty(p.RequestID)
+
+	serversPool[0].isHealthy = false
+	rw = httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+	assert.Equal(http.StatusServiceUnavailable, rw.Code)
+	assert.Nil(json.Unmarshal(rw.Body.Bytes(), &p))
+	assert.Equal(http.StatusServiceUnavailable, p.Status)
+	assert.Contains(p.Detail, errNoHealthyServers.Error())
+}
+
+func TestFailureStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.Equal(http.StatusGatewayTimeout, failureStatus(r, &timeoutError{phase: "dial", err: context.DeadlineExceeded}))
+	assert.Equal(http.StatusServiceUnavailable, failureStatus(r, errQueueFull))
+	assert.Equal(http.StatusBadGateway, failureStatus(r, os.ErrClosed))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(statusClientClosedRequest, failureStatus(r.WithContext(ctx), context.Canceled))
+}
+
+func TestRouteErrorPages(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-error-pages")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.json")
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "503.html"), []byte("<h1>Be right back</h1>"), 0o600))
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"routes": [{"prefix": "/shop", "errorPages": {"503": "503.html"}}]}`), 0o600))
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer routes.set(nil)
+	routes.set(cfg.Routes)
+
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = nil
+
+	rw := httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/shop/cart", nil))
+	assert.Equal(http.StatusServiceUnavailable, rw.Code)
+	assert.Equal("text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Equal("<h1>Be right back</h1>", rw.Body.String())
+
+	rw = httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/api", nil))
+	assert.Equal(problemContentType, rw.Header().Get("Content-Type"))
+
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"routes": [{"prefix": "/", "errorPages": {"200": "503.html"}}]}`), 0o600))
+	_, err = loadConfig(path)
+	assert.NotNil(err)
+}
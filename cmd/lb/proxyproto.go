@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+
+	proxyHeaderTimeout = 5 * time.Second
+	maxProxyV1Header   = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var proxyHeaderErrors = expvar.NewInt("lb_proxy_protocol_errors_total")
+
+// parseCIDRs reads a comma-separated list of networks, a bare address is
+// a network of its own.
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var res []*net.IPNet
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			res = append(res, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, network)
+	}
+	return res, nil
+}
+
+func containsIP(networks []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && networksContain(networks, tcpAddr.IP)
+}
+
+func networksContain(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyListener reads PROXY protocol headers, v1 or v2, off connections
+// from trusted load balancers and reports the client they carry as the
+// remote address. Other peers are served as they are.
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || !containsIP(l.trusted, conn.RemoteAddr()) {
+		return conn, err
+	}
+	return &proxiedConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxiedConn parses the header on first use, so that a slow peer does
+// not hold up the accept loop.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	source net.Addr
+	dest   net.Addr
+	err    error
+}
+
+func (c *proxiedConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.source, c.dest, c.err = readProxyHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			proxyHeaderErrors.Add(1)
+			c.err = fmt.Errorf("PROXY header from %s: %s", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	if c.init(); c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	if c.init(); c.dest != nil {
+		return c.dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *proxiedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader returns the addresses a PROXY header carries, or nil
+// ones for LOCAL and UNKNOWN connections such as health checks.
+func readProxyHeader(r *bufio.Reader) (source, dest net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case proxyV2Signature[0]:
+		signature, err := r.Peek(len(proxyV2Signature))
+		if err != nil {
+			return nil, nil, err
+		}
+		if bytes.Equal(signature, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	case 'P':
+		return readProxyV1(r)
+	}
+	return nil, nil, errors.New("missing PROXY protocol header")
+}
+
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < maxProxyV1Header {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte("PROXY ")) || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("malformed or too long v1 header")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	source, err := proxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dest, err := proxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, dest, nil
+}
+
+func proxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if addr.IP == nil || err != nil {
+		return nil, fmt.Errorf("bad v1 address %s:%s", ip, port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	const cmdLocal, cmdProxy = 0, 1
+	switch header[12] & 0xf {
+	case cmdLocal:
+		return nil, nil, nil
+	case cmdProxy:
+	default:
+		return nil, nil, fmt.Errorf("unknown v2 command %d", header[12]&0xf)
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// UNSPEC and unix sockets carry no TCP client address.
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errors.New("v2 address block is too short")
+	}
+	ports := body[2*ipLen:]
+	source := &net.TCPAddr{IP: net.IP(body[:ipLen]), Port: int(binary.BigEndian.Uint16(ports))}
+	dest := &net.TCPAddr{IP: net.IP(body[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	return source, dest, nil
+}
+
+// writeProxyHeader tells a server in TCP mode who the client is. Mixed
+// address families are sent as IPv6, with IPv4 addresses mapped into it.
+func writeProxyHeader(w io.Writer, version string, source, dest net.Addr) error {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := dest.(*net.TCPAddr)
+	known := srcOk && dstOk
+	var srcIP, dstIP net.IP
+	if known {
+		srcIP, dstIP = src.IP.To4(), dst.IP.To4()
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+		}
+	}
+
+	if version == proxyProtocolV1 {
+		line := "PROXY UNKNOWN\r\n"
+		if known {
+			line = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcIP, dstIP, src.Port, dst.Port)
+			if len(srcIP) == net.IPv6len {
+				line = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ipv6String(srcIP), ipv6String(dstIP), src.Port, dst.Port)
+			}
+		}
+		_, err := io.WriteString(w, line)
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	if !known {
+		// LOCAL command without addresses.
+		buf.Write([]byte{0x20, 0x00, 0, 0})
+	} else {
+		family := byte(0x11)
+		if len(srcIP) == net.IPv6len {
+			family = 0x21
+		}
+		buf.Write([]byte{0x21, family})
+		_ = binary.Write(&buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		_ = binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		_ = binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ipv6String keeps IPv4-mapped addresses in IPv6 notation.
+func ipv6String(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
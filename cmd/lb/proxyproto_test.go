@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		source, dest *net.TCPAddr
+		want         string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, "203.0.113.7:51000"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8080}, "[2001:db8::1]:443"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}, "[2001:db8::1]:443"},
+	}
+	for _, version := range []string{proxyProtocolV1, proxyProtocolV2} {
+		for _, c := range cases {
+			var buf bytes.Buffer
+			assert.Nil(writeProxyHeader(&buf, version, c.source, c.dest))
+			buf.WriteString("payload")
+			r := bufio.NewReader(&buf)
+			source, dest, err := readProxyHeader(r)
+			assert.Nil(err, "%s %s", version, c.want)
+			if assert.NotNil(source) {
+				assert.Equal(c.want, source.String())
+				assert.Equal(c.dest.Port, dest.(*net.TCPAddr).Port)
+			}
+			rest, _ := r.ReadString(0)
+			assert.Equal("payload", rest)
+		}
+
+		var buf bytes.Buffer
+		assert.Nil(writeProxyHeader(&buf, version, &net.UnixAddr{Name: "/tmp/lb.sock"}, nil))
+		source, _, err := readProxyHeader(bufio.NewReader(&buf))
+		assert.Nil(err)
+		assert.Nil(source, "%s connections without a TCP client keep their address", version)
+	}
+
+	for _, bad := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 1.2.3.4\r\n", "PROXY TCP4 1.2.3.4 5.6.7.8 99999 80\r\n", "PROXY " + strings.Repeat("x", 200)} {
+		_, _, err := readProxyHeader(bufio.NewReader(strings.NewReader(bad)))
+		assert.NotNil(err, bad)
+	}
+}
+
+func TestProxyListenerHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	trusted, err := parseCIDRs("127.0.0.0/8, ::1")
+	assert.Nil(err)
+	_, err = parseCIDRs("10.0.0.0/33")
+	assert.NotNil(err)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(rw, r.RemoteAddr)
+	}))
+	backend.Listener = &proxyListener{Listener: backend.Listener, trusted: trusted}
+	backend.Start()
+	defer backend.Close()
+
+	conn, err := net.Dial("tcp", backendHost(backend))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 51000 80\r\nGET / HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := new(bytes.Buffer)
+	_, _ = body.ReadFrom(resp.Body)
+	assert.Equal("203.0.113.7:51000", body.String())
+
+	// Peers that are not trusted are served as they are.
+	elsewhere, _ := parseCIDRs("10.0.0.0/8")
+	plain := httptest.NewUnstartedServer(backend.Config.Handler)
+	plain.Listener = &proxyListener{Listener: plain.Listener, trusted: elsewhere}
+	plain.Start()
+	defer plain.Close()
+	direct, err := http.Get(plain.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer direct.Body.Close()
+	body.Reset()
+	_, _ = body.ReadFrom(direct.Body)
+	assert.True(strings.HasPrefix(body.String(), "127.0.0.1:"), body.String())
+}
+
+func TestTCPProxySendsProxyHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	loopback, _ := parseCIDRs("127.0.0.1")
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = &proxyListener{Listener: backend, trusted: loopback}
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = fmt.Fprintf(conn, "%s %s", conn.RemoteAddr(), line)
+	}()
+
+	defer func(old []*server, oldVersion string) {
+		serversPool, *proxyProtocolUpstream = old, oldVersion
+	}(serversPool, *proxyProtocolUpstream)
+	serversPool = parseHosts(backend.Addr().String())
+	*proxyProtocolUpstream = proxyProtocolV2
+
+	frontend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer frontend.Close()
+	go serveTCP(&proxyListener{Listener: frontend, trusted: loopback}, time.Second)
+
+	conn, err := net.Dial("tcp", frontend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprint(conn, "PROXY TCP4 203.0.113.7 10.0.0.1 51000 80\r\nhello\n")
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal("203.0.113.7:51000 hello\n", reply)
+}
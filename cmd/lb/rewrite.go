@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// rewriteConfig transforms requests of a route on their way to servers
+// and responses on their way back. The path is changed in the order of
+// the fields: StripPrefix, AddPrefix, then each of Path.
+type rewriteConfig struct {
+	StripPrefix string        `json:"stripPrefix,omitempty"`
+	AddPrefix   string        `json:"addPrefix,omitempty"`
+	Path        []pathRewrite `json:"path,omitempty"`
+	// Query sets parameters on the request URL.
+	Query    map[string]string `json:"query,omitempty"`
+	Request  headerRewrite     `json:"request,omitempty"`
+	Response headerRewrite     `json:"response,omitempty"`
+}
+
+// pathRewrite replaces matches of a regular expression in the path,
+// Replace can refer to groups as $1 or ${name}.
+type pathRewrite struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// headerRewrite changes headers: Remove goes first, then Set replaces
+// values and Add appends them.
+type headerRewrite struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+func (rc *rewriteConfig) compile() error {
+	if rc.AddPrefix != "" && !strings.HasPrefix(rc.AddPrefix, "/") {
+		return fmt.Errorf("rewrite addPrefix %q must start with /", rc.AddPrefix)
+	}
+	for i := range rc.Path {
+		re, err := regexp.Compile(rc.Path[i].Match)
+		if err != nil {
+			return fmt.Errorf("rewrite path: %s", err)
+		}
+		rc.Path[i].re = re
+	}
+	return nil
+}
+
+// rewritePath applies the path rules to path.
+func (rc *rewriteConfig) rewritePath(path string) string {
+	if rc.StripPrefix != "" && hasPathPrefix(path, rc.StripPrefix) {
+		path = strings.TrimPrefix(path, rc.StripPrefix)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+	if rc.AddPrefix != "" {
+		path = strings.TrimSuffix(rc.AddPrefix, "/") + path
+	}
+	for _, pr := range rc.Path {
+		path = pr.re.ReplaceAllString(path, pr.Replace)
+	}
+	return path
+}
+
+// rewriteRequest changes a request cloned for a server.
+func (rc *rewriteConfig) rewriteRequest(r *http.Request) {
+	if path := rc.rewritePath(r.URL.Path); path != r.URL.Path {
+		r.URL.Path, r.URL.RawPath = path, ""
+	}
+	r.URL.RawQuery = rc.rewriteQuery(r.URL.RawQuery)
+	rc.Request.apply(r.Header)
+	// The Host header lives outside of the header map.
+	if host := r.Header.Get("Host"); host != "" {
+		r.Host = host
+		r.Header.Del("Host")
+	}
+}
+
+// rewriteQuery sets the query parameters, leaving the rest of the query
+// as the client sent it.
+func (rc *rewriteConfig) rewriteQuery(rawQuery string) string {
+	query, _ := url.ParseQuery(rawQuery)
+	changed := make(map[string]bool)
+	var names []string
+	for name, value := range rc.Query {
+		if values := query[name]; len(values) != 1 || values[0] != value {
+			changed[name] = true
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return rawQuery
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, pair := range strings.Split(rawQuery, "&") {
+		name := strings.SplitN(pair, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if pair != "" && !changed[name] {
+			pairs = append(pairs, pair)
+		}
+	}
+	for _, name := range names {
+		pairs = append(pairs, url.QueryEscape(name)+"="+url.QueryEscape(rc.Query[name]))
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (hr headerRewrite) apply(h http.Header) {
+	for _, name := range hr.Remove {
+		h.Del(name)
+	}
+	for name, value := range hr.Set {
+		h.Set(name, value)
+	}
+	for name, value := range hr.Add {
+		h.Add(name, value)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRewritePath(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := &rewriteConfig{StripPrefix: "/v2", AddPrefix: "/api/v1/"}
+	assert.Nil(rc.compile())
+	assert.Equal("/api/v1/some-data", rc.rewritePath("/v2/some-data"))
+	assert.Equal("/api/v1/", rc.rewritePath("/v2"))
+	assert.Equal("/api/v1/other", rc.rewritePath("/other"))
+	assert.Equal("/api/v1/v2foo", rc.rewritePath("/v2foo"))
+
+	rc = &rewriteConfig{Path: []pathRewrite{
+		{Match: `^/users/(\d+)/posts$`, Replace: "/posts/by-user/$1"},
+		{Match: `^/u/(?P<name>\w+)$`, Replace: "/users/${name}"},
+	}}
+	assert.Nil(rc.compile())
+	assert.Equal("/posts/by-user/42", rc.rewritePath("/users/42/posts"))
+	assert.Equal("/users/bob", rc.rewritePath("/u/bob"))
+	assert.Equal("/users/x/posts", rc.rewritePath("/users/x/posts"))
+
+	assert.NotNil((&rewriteConfig{Path: []pathRewrite{{Match: "("}}}).compile())
+	assert.NotNil((&rewriteConfig{AddPrefix: "api"}).compile())
+}
+
+func TestRewriteQuery(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := &rewriteConfig{Query: map[string]string{"source": "v2", "debug": "0"}}
+	assert.Equal("b=2&a=1&debug=0&source=v2", rc.rewriteQuery("b=2&a=1"))
+	assert.Equal("z=%2f&a=1&debug=0&source=v2", rc.rewriteQuery("z=%2f&source=v1&a=1&source=v3"))
+	assert.Equal("z=%2f&debug=0&source=v2", rc.rewriteQuery("z=%2f&debug=0&source=v2"), "nothing to change")
+	assert.Equal("debug=0&source=v2", rc.rewriteQuery(""))
+	assert.Equal("z=%2f", (&rewriteConfig{}).rewriteQuery("z=%2f"))
+}
+
+func TestPathPrefix(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(hasPathPrefix("/v2", "/v2"))
+	assert.True(hasPathPrefix("/v2/data", "/v2"))
+	assert.True(hasPathPrefix("/v2/data", "/v2/"))
+	assert.True(hasPathPrefix("/anything", "/"))
+	assert.False(hasPathPrefix("/v2foo", "/v2"))
+	assert.False(hasPathPrefix("/v", "/v2"))
+
+	table := new(routeTable)
+	table.set([]routeConfig{{Prefix: "/v2"}})
+	assert.Equal("/v2", table.match("/v2/data").Prefix)
+	assert.Equal("/", table.match("/v2foo").Prefix)
+}
+
+func TestRouteRewrites(t *testing.T) {
+	assert := assert.New(t)
+
+	echo := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Server-Name", name)
+			rw.Header().Set("X-Powered-By", "php")
+			rw.Header().Set("Seen-Host", r.Host)
+			rw.Header().Set("Seen-Tenant", r.Header.Get("X-Tenant"))
+			rw.Header().Set("Seen-Cookie", r.Header.Get("Cookie"))
+			_, _ = rw.Write([]byte(r.URL.RequestURI()))
+		}))
+	}
+	stable, db := echo("stable"), echo("db")
+	defer stable.Close()
+	defer db.Close()
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(stable))
+	setupPool("db", nil, poolConfig{Servers: []string{backendHost(db)}})
+	defer func() {
+		poolsMux.Lock()
+		delete(pools, "db")
+		poolsMux.Unlock()
+	}()
+
+	dir, err := ioutil.TempDir("", "test-rewrite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lb.json")
+	assert.Nil(ioutil.WriteFile(path, []byte(`{
+		"pools": {"db": {"servers": ["`+backendHost(db)+`"]}},
+		"routes": [
+			{"prefix": "/db/", "pool": "db"},
+			{"prefix": "/v2/", "rewrite": {
+				"stripPrefix": "/v2",
+				"addPrefix": "/api/v1",
+				"query": {"source": "v2"},
+				"request": {"remove": ["Cookie"], "set": {"X-Tenant": "acme", "Host": "api.internal"}},
+				"response": {"remove": ["X-Powered-By"], "add": {"X-Api-Version": "2"}}
+			}}
+		]
+	}`), 0o600))
+	cfg, err := loadConfig(path)
+	if !assert.Nil(err) {
+		return
+	}
+	applyConfig(cfg)
+	defer applyConfig(&config{})
+
+	send := func(target string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		r.Header.Set("X-Tenant", "evil")
+		r.Header.Set("Cookie", "session=1")
+		rw := httptest.NewRecorder()
+		handleRequest(rw, r)
+		return rw
+	}
+
+	rw := send("/db/tables?limit=1")
+	assert.Equal("db", rw.Header().Get("Server-Name"))
+	assert.Equal("/db/tables?limit=1", rw.Body.String())
+	assert.Equal("php", rw.Header().Get("X-Powered-By"))
+
+	rw = send("/v2/some-data?limit=1")
+	assert.Equal("stable", rw.Header().Get("Server-Name"))
+	assert.Equal("/api/v1/some-data?limit=1&source=v2", rw.Body.String())
+	assert.Equal("api.internal", rw.Header().Get("Seen-Host"))
+	assert.Equal("acme", rw.Header().Get("Seen-Tenant"))
+	assert.Empty(rw.Header().Get("Seen-Cookie"))
+	assert.Empty(rw.Header().Get("X-Powered-By"))
+	assert.Equal("2", rw.Header().Get("X-Api-Version"))
+
+	rw = send("/api/v1/some-data")
+	assert.Equal("/api/v1/some-data", rw.Body.String())
+	assert.Equal("evil", rw.Header().Get("Seen-Tenant"))
+
+	assert.Nil(ioutil.WriteFile(path, []byte(`{"routes": [{"prefix": "/db/", "pool": "nowhere"}]}`), 0o600))
+	_, err = loadConfig(path)
+	assert.NotNil(err)
+
+	// Pools are only set up at startup, reloads cannot add them.
+	assert.Nil(cfg.checkReload())
+	assert.Nil(ioutil.WriteFile(path, []byte(`{
+		"pools": {"cache": {"servers": ["cache:8080"]}},
+		"routes": [{"prefix": "/cache/", "pool": "cache"}]
+	}`), 0o600))
+	cfg, err = loadConfig(path)
+	if assert.Nil(err) {
+		assert.NotNil(cfg.checkReload())
+	}
+}
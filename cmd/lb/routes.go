@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type routeConfig struct {
+	// Prefix is matched against the request path, the longest match wins.
+	Prefix   string        `json:"prefix"`
+	Timeouts timeoutConfig `json:"timeouts,omitempty"`
+	// ErrorPages maps error statuses (401, 403, 502, 503, 504) to files served
+	// instead of the default problem+json body.
+	ErrorPages map[int]string `json:"errorPages,omitempty"`
+	// Priority "low" makes requests to the route the first to be shed
+	// when servers are at their limits.
+	Priority string `json:"priority,omitempty"`
+	// Auth, if set, lets through only requests with valid credentials.
+	Auth *authConfig `json:"auth,omitempty"`
+	// Access narrows the clients let through on top of the global lists.
+	Access *accessConfig `json:"access,omitempty"`
+	// Pool names the pool serving the route, the stable one by default.
+	Pool    string         `json:"pool,omitempty"`
+	Rewrite *rewriteConfig `json:"rewrite,omitempty"`
+
+	pages map[int]errorPage
+}
+
+func (rc routeConfig) validate() error {
+	if !strings.HasPrefix(rc.Prefix, "/") {
+		return fmt.Errorf("route prefix %q must start with /", rc.Prefix)
+	}
+	if err := rc.Timeouts.validate(); err != nil {
+		return fmt.Errorf("route %s: %s", rc.Prefix, err)
+	}
+	if rc.Priority != "" && rc.Priority != priorityLow {
+		return fmt.Errorf("route %s: unknown priority %q", rc.Prefix, rc.Priority)
+	}
+	if rc.Auth != nil {
+		if err := rc.Auth.validate(); err != nil {
+			return fmt.Errorf("route %s: %s", rc.Prefix, err)
+		}
+	}
+	for status := range rc.ErrorPages {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("route %s: error page for non-error status %d", rc.Prefix, status)
+		}
+	}
+	return nil
+}
+
+// load reads the files the route refers to, relative paths are resolved
+// against dir.
+func (rc *routeConfig) load(dir string) error {
+	if rc.Rewrite != nil {
+		if err := rc.Rewrite.compile(); err != nil {
+			return fmt.Errorf("route %s: %s", rc.Prefix, err)
+		}
+	}
+	if rc.Access != nil {
+		if err := rc.Access.parse(); err != nil {
+			return fmt.Errorf("route %s: %s", rc.Prefix, err)
+		}
+	}
+	if rc.Auth != nil {
+		if err := rc.Auth.load(dir); err != nil {
+			return fmt.Errorf("route %s: %s", rc.Prefix, err)
+		}
+	}
+	return rc.loadErrorPages(dir)
+}
+
+func (rc *routeConfig) loadErrorPages(dir string) error {
+	rc.pages = make(map[int]errorPage)
+	for status, path := range rc.ErrorPages {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		page, err := loadErrorPage(path)
+		if err != nil {
+			return fmt.Errorf("route %s: %s", rc.Prefix, err)
+		}
+		rc.pages[status] = page
+	}
+	return nil
+}
+
+var (
+	defaultRoute = &routeConfig{Prefix: "/"}
+	routes       = new(routeTable)
+)
+
+type routeTable struct {
+	mux    sync.RWMutex
+	routes []*routeConfig
+	// claimHeaders lists the headers JWT claims go to on any route.
+	claimHeaders []string
+}
+
+func (t *routeTable) set(rcs []routeConfig) {
+	res := make([]*routeConfig, len(rcs))
+	for i := range rcs {
+		res[i] = &rcs[i]
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return len(res[i].Prefix) > len(res[j].Prefix)
+	})
+	var claimHeaders []string
+	for _, rc := range res {
+		if rc.Auth != nil && rc.Auth.JWT != nil {
+			for _, header := range rc.Auth.JWT.Claims {
+				claimHeaders = append(claimHeaders, header)
+			}
+		}
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.routes = res
+	t.claimHeaders = claimHeaders
+}
+
+// stripIdentity removes identity headers sent by the client, so that
+// routes without auth cannot be used to pass forged ones to servers.
+func (t *routeTable) stripIdentity(r *http.Request) {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	r.Header.Del(authSubjectHeader)
+	for _, header := range t.claimHeaders {
+		r.Header.Del(header)
+	}
+}
+
+// match returns the route with the longest prefix of path, falling back
+// to the default route.
+func (t *routeTable) match(path string) *routeConfig {
+	t.mux.RLock()
+	defer t.mux.RUnlock()
+	for _, rc := range t.routes {
+		if hasPathPrefix(path, rc.Prefix) {
+			return rc
+		}
+	}
+	return defaultRoute
+}
+
+// hasPathPrefix reports whether prefix is made of whole segments of path,
+// so that /v2 matches /v2 and /v2/data but not /v2foo.
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
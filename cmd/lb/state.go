@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/cmd/db/datastore"
+)
+
+const stateKeyPrefix = "server/"
+
+// serverState is what the balancer remembers of a server across restarts.
+type serverState struct {
+	Traffic   int       `json:"traffic"`
+	Healthy   bool      `json:"healthy"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Failures  int       `json:"failures"`
+	Draining  bool      `json:"draining"`
+}
+
+// stateStore checkpoints server state into a datastore directory.
+type stateStore struct {
+	db   *datastore.Db
+	done chan struct{}
+}
+
+func openStateStore(dir string) (*stateStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	db, err := datastore.NewDb(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &stateStore{db: db, done: make(chan struct{})}, nil
+}
+
+// restore applies saved state to servers that are still configured and
+// returns how many of them it found.
+func (st *stateStore) restore(servers []*server) int {
+	restored := 0
+	for _, s := range servers {
+		value, err := st.db.Get(stateKeyPrefix + s.host)
+		if err != nil || value == "" {
+			continue
+		}
+		var saved serverState
+		if err := json.Unmarshal([]byte(value), &saved); err != nil {
+			log.Printf("Ignoring saved state of %s: %s", s.host, err)
+			continue
+		}
+		backendLimiter.mux.Lock()
+		s.traffic = saved.Traffic
+		s.isHealthy = saved.Healthy
+		s.checkedAt = saved.CheckedAt
+		s.failures = saved.Failures
+		s.draining = saved.Draining
+		backendLimiter.mux.Unlock()
+		restored++
+	}
+	return restored
+}
+
+func (st *stateStore) checkpoint(servers []*server) error {
+	for _, s := range servers {
+		backendLimiter.mux.Lock()
+		saved := serverState{
+			Traffic:   s.traffic,
+			Healthy:   s.isHealthy,
+			CheckedAt: s.checkedAt,
+			Failures:  s.failures,
+			Draining:  s.draining,
+		}
+		backendLimiter.mux.Unlock()
+		data, err := json.Marshal(saved)
+		if err != nil {
+			return err
+		}
+		if err := st.db.Put(stateKeyPrefix+s.host, string(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run checkpoints all servers every interval until close.
+func (st *stateStore) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := st.checkpoint(allServers()); err != nil {
+				log.Printf("Failed to checkpoint state: %s", err)
+			}
+		case <-st.done:
+			return
+		}
+	}
+}
+
+// close writes a last checkpoint and stops run.
+func (st *stateStore) close() error {
+	close(st.done)
+	if err := st.checkpoint(allServers()); err != nil {
+		return err
+	}
+	return st.db.Close()
+}
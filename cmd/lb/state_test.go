@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateSurvivesRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "test-lb-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	checkedAt := time.Now().Add(-time.Minute).UTC()
+	before := parseHosts("server1:8080,server2:8080")
+	before[0].traffic = 1024
+	before[0].draining = true
+	before[1].isHealthy = false
+	before[1].checkedAt = checkedAt
+	before[1].failures = 3
+
+	st, err := openStateStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(st.checkpoint(before))
+	assert.Nil(st.db.Close())
+
+	after := parseHosts("server1:8080,server2:8080,server3:8080")
+	st, err = openStateStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.db.Close()
+	assert.Equal(2, st.restore(after))
+
+	assert.Equal(1024, after[0].traffic)
+	assert.True(after[0].draining)
+	assert.True(after[0].isHealthy)
+	assert.False(after[1].isHealthy)
+	assert.True(checkedAt.Equal(after[1].checkedAt))
+	assert.Equal(3, after[1].failures)
+	assert.True(after[2].isHealthy, "unknown servers keep their defaults")
+	assert.Zero(after[2].traffic)
+}
+
+func TestSetHealthyKeepsHistory(t *testing.T) {
+	s := &server{host: "server1:8080", isHealthy: true}
+	setHealthy(s, false)
+	setHealthy(s, false)
+	assert.Equal(t, 2, s.failures)
+	assert.False(t, s.checkedAt.IsZero())
+	setHealthy(s, true)
+	assert.Zero(t, s.failures)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	strategyLeastTraffic     = "least-traffic"
+	strategyLeastConnections = "least-conn"
+)
+
+var errNoHealthyServers = errors.New("no healthy servers at moment")
+
+// strategy picks the server to send the next request or connection to.
+type strategy func(servers []*server) (*server, error)
+
+var (
+	strategies = map[string]strategy{
+		strategyLeastTraffic:     balance,
+		strategyLeastConnections: leastConnections,
+	}
+	balanceStrategy strategy = balance
+)
+
+func strategyByName(name string) (strategy, error) {
+	s, ok := strategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown balancing strategy %q, expected one of %v", name, strategyNames())
+	}
+	return s, nil
+}
+
+// strategyOrDefault picks least-conn for TCP and least-traffic for HTTP
+// when no strategy is given.
+func strategyOrDefault(name, mode string) string {
+	if name != "" {
+		return name
+	}
+	if mode == modeTCP {
+		return strategyLeastConnections
+	}
+	return strategyLeastTraffic
+}
+
+func strategyNames() []string {
+	var names []string
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func healthy(servers []*server) []*server {
+	var res []*server
+	for _, server := range servers {
+		if server.available() {
+			res = append(res, server)
+		}
+	}
+	return res
+}
+
+// leastConnections picks the healthy server with the fewest requests or
+// connections in flight.
+func leastConnections(servers []*server) (*server, error) {
+	healthyServers := healthy(servers)
+	if len(healthyServers) == 0 {
+		return nil, errNoHealthyServers
+	}
+	optimalServer := healthyServers[0]
+	for _, server := range healthyServers[1:] {
+		if server.inFlight < optimalServer.inFlight {
+			optimalServer = server
+		}
+	}
+	return optimalServer, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	modeHTTP = "http"
+	modeTCP  = "tcp"
+)
+
+var (
+	tcpAcceptors sync.WaitGroup
+	tcpConns     sync.WaitGroup
+)
+
+// startTCP serves l in the background until it is closed.
+func startTCP(l net.Listener, idle time.Duration) {
+	tcpAcceptors.Add(1)
+	go func() {
+		defer tcpAcceptors.Done()
+		serveTCP(l, idle)
+	}()
+}
+
+// serveTCP proxies every accepted connection to a server picked from the
+// stable pool, copying bytes both ways until either side is done.
+func serveTCP(l net.Listener, idle time.Duration) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Printf("TCP listener finished: %s", err)
+			return
+		}
+		tcpConns.Add(1)
+		go func() {
+			defer tcpConns.Done()
+			proxyConn(conn, idle)
+		}()
+	}
+}
+
+// waitTCPConns waits for proxied connections to finish or ctx to expire.
+// The listeners must be closed by then.
+func waitTCPConns(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		// Once no listener accepts, no connection is added while waiting.
+		tcpAcceptors.Wait()
+		tcpConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func proxyConn(client net.Conn, idle time.Duration) {
+	defer client.Close()
+	if !access.allowsConn(client) {
+		log.Printf("tcp %s: client address not allowed", client.RemoteAddr())
+		return
+	}
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	dst, err := backendLimiter.acquire(ctx, serversPool)
+	if err != nil {
+		cancel()
+		log.Printf("tcp %s: %s", client.RemoteAddr(), err)
+		return
+	}
+	defer backendLimiter.release(dst)
+	upstream, err := poolOf(dst).dial(withTimeouts(ctx, defaultTimeouts), "tcp", dst.host)
+	cancel()
+	if err != nil {
+		log.Printf("tcp %s: failed to connect to %s: %s", client.RemoteAddr(), dst.host, err)
+		return
+	}
+	defer upstream.Close()
+	if *proxyProtocolUpstream != "" {
+		if err := writeProxyHeader(upstream, *proxyProtocolUpstream, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			log.Printf("tcp %s: failed to send PROXY header to %s: %s", client.RemoteAddr(), dst.host, err)
+			return
+		}
+	}
+
+	sent, received := splice(client, upstream, idle)
+	backendLimiter.addTraffic(dst, int(sent+received))
+	log.Printf("tcp %s -> %s: sent %d, received %d bytes in %s",
+		client.RemoteAddr(), dst.host, sent, received, time.Since(start).Round(time.Millisecond))
+}
+
+// splice copies data in both directions, half-closing each side when the
+// other one stops sending. Connections idle for longer than idle are cut.
+func splice(client, upstream net.Conn, idle time.Duration) (sent, received int64) {
+	activity := &lastActivity{}
+	activity.touch()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sent = copyIdle(upstream, &idleConn{Conn: client, idle: idle, activity: activity})
+	}()
+	go func() {
+		defer wg.Done()
+		received = copyIdle(client, &idleConn{Conn: upstream, idle: idle, activity: activity})
+	}()
+	wg.Wait()
+	return sent, received
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func copyIdle(dst net.Conn, src *idleConn) int64 {
+	n, err := io.Copy(dst, src)
+	if cw, ok := dst.(closeWriter); ok && err == nil {
+		_ = cw.CloseWrite()
+	} else {
+		// Unblock the opposite direction as well.
+		_ = dst.Close()
+		_ = src.Close()
+	}
+	return n
+}
+
+type lastActivity struct {
+	unixNano int64
+}
+
+func (a *lastActivity) touch() {
+	atomic.StoreInt64(&a.unixNano, time.Now().UnixNano())
+}
+
+func (a *lastActivity) since() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.unixNano)))
+}
+
+// idleConn fails reads once neither direction of the spliced connection
+// has moved any data for the idle period.
+type idleConn struct {
+	net.Conn
+	idle     time.Duration
+	activity *lastActivity
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	for {
+		if c.idle > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.idle - c.activity.since()))
+		}
+		n, err := c.Conn.Read(p)
+		if n > 0 {
+			c.activity.touch()
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 && c.activity.since() < c.idle {
+			continue
+		}
+		return n, err
+	}
+}
+
+func tcpHealth(dst *server) bool {
+	conn, err := poolOf(dst).dial(withTimeouts(context.Background(), timeoutConfig{Dial: duration(timeout)}), "tcp", dst.host)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
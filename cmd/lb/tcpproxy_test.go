@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startEchoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCPProxy(t *testing.T) {
+	assert := assert.New(t)
+
+	echo := startEchoServer(t)
+	defer echo.Close()
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(echo.Addr().String())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	startTCP(l, 50*time.Millisecond)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping\n"))
+	assert.Nil(err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(err)
+	assert.Equal("ping\n", line)
+
+	// The proxy drops the connection once it stays idle.
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(io.EOF, err)
+
+	// Draining stops accepting and waits for proxied connections.
+	l.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	waitTCPConns(ctx)
+	assert.Nil(ctx.Err())
+
+	assert.True(tcpHealth(serversPool[0]))
+	assert.False(tcpHealth(&server{host: l.Addr().String() + "0"}))
+}
+
+func TestLeastConnections(t *testing.T) {
+	assert := assert.New(t)
+
+	servers := []*server{
+		{host: "server1:8080", isHealthy: true, inFlight: 3, traffic: 1},
+		{host: "server2:8080", isHealthy: true, inFlight: 1, traffic: 100},
+		{host: "server3:8080", isHealthy: false, inFlight: 0},
+	}
+	s, err := leastConnections(servers)
+	assert.Nil(err)
+	assert.Equal("server2:8080", s.host)
+
+	_, err = leastConnections(servers[2:])
+	assert.Equal(errNoHealthyServers, err)
+
+	_, err = strategyByName("random")
+	assert.NotNil(err)
+}
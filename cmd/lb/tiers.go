@@ -0,0 +1,57 @@
+package main
+
+import (
+	"expvar"
+	"strconv"
+)
+
+// tierRequests counts requests served by servers below the first tier.
+var tierRequests = expvar.NewMap("lb_tier_spillover_total")
+
+// activeTiers narrows candidates to the tiers in use: the first one, and
+// each next one while those before it are short of healthy servers. The
+// caller must hold backendLimiter.mux.
+func activeTiers(candidates []*server) []*server {
+	last := 0
+	for _, s := range candidates {
+		if s.tier > last {
+			last = s.tier
+		}
+	}
+	if last == 0 {
+		return candidates
+	}
+	minHealthy := poolOf(candidates[0]).minHealthy
+	var res []*server
+	for tier := 0; tier <= last; tier++ {
+		total, up := 0, 0
+		for _, s := range candidates {
+			if s.tier == tier {
+				res = append(res, s)
+				total++
+				if s.available() {
+					up++
+				}
+			}
+		}
+		if up > 0 && float64(up) >= minHealthy*float64(total) {
+			break
+		}
+	}
+	return res
+}
+
+// countSpillover records the tier and zone of a server picked for a
+// request.
+func countSpillover(s *server) {
+	if s.tier > 0 {
+		tierRequests.Add(strconv.Itoa(s.tier), 1)
+	}
+	if *zone != "" {
+		if s.zone == *zone {
+			zoneRequests.Add(zoneLocal, 1)
+		} else {
+			zoneRequests.Add(zoneRemote, 1)
+		}
+	}
+}
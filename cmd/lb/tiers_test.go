@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hostsOf(servers []*server) []string {
+	var res []string
+	for _, s := range servers {
+		res = append(res, s.host)
+	}
+	return res
+}
+
+func TestActiveTiers(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func() {
+		poolsMux.Lock()
+		delete(pools, "tiered")
+		poolsMux.Unlock()
+	}()
+	servers := setupPool("tiered", nil, poolConfig{
+		Servers: []string{"a:8080", "b:8080"},
+		Tiers:   [][]string{{"c:8080"}},
+		Backups: []string{"backup:8080"},
+	})
+	assert.Equal([]int{0, 0, 1, 2}, []int{servers[0].tier, servers[1].tier, servers[2].tier, servers[3].tier})
+	a, b, c := servers[0], servers[1], servers[2]
+
+	assert.Equal([]string{"a:8080", "b:8080"}, hostsOf(activeTiers(servers)))
+	a.isHealthy = false
+	assert.Equal([]string{"a:8080", "b:8080"}, hostsOf(activeTiers(servers)), "one healthy server is enough by default")
+	servers[0].pool.minHealthy = 0.75
+	assert.Equal([]string{"a:8080", "b:8080", "c:8080"}, hostsOf(activeTiers(servers)))
+	servers[0].pool.minHealthy = 0
+	b.draining = true
+	assert.Equal([]string{"a:8080", "b:8080", "c:8080"}, hostsOf(activeTiers(servers)))
+	c.isHealthy = false
+	assert.Equal([]string{"a:8080", "b:8080", "c:8080", "backup:8080"}, hostsOf(activeTiers(servers)))
+
+	untiered := parseHosts("x:8080, y:8080")
+	assert.Equal(untiered, activeTiers(untiered))
+
+	assert.NotNil(poolConfig{MinHealthy: 1.5}.validate())
+}
+
+func TestLimiterSpillsOver(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := &server{host: "primary:8080", isHealthy: true}
+	backup := &server{host: "backup:8080", isHealthy: true, tier: 1}
+	candidates := []*server{primary, backup}
+	l := newLimiter(0, 0, 0)
+
+	dst, err := l.acquire(context.Background(), candidates)
+	assert.Nil(err)
+	assert.Equal(primary, dst)
+	l.release(dst)
+
+	spilled := func() int64 {
+		if v, ok := tierRequests.Get("1").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := spilled()
+	primary.isHealthy = false
+	dst, err = l.acquire(context.Background(), candidates)
+	assert.Nil(err)
+	assert.Equal(backup, dst)
+	l.release(dst)
+	assert.Equal(before+1, spilled())
+
+	backup.isHealthy = false
+	_, err = l.acquire(context.Background(), candidates)
+	assert.Equal(errNoHealthyServers, err)
+}
+
+func TestPinnedFollowsTiers(t *testing.T) {
+	assert := assert.New(t)
+
+	primary := &server{host: "primary:8080", isHealthy: true}
+	backup := &server{host: "backup:8080", isHealthy: true, tier: 1}
+	candidates := []*server{primary, backup}
+	l := newLimiter(0, 0, 0)
+
+	assert.True(l.keepsPin(primary, candidates))
+	assert.False(l.keepsPin(backup, candidates), "clients leave the backup once the primary is up")
+	primary.isHealthy = false
+	assert.True(l.keepsPin(backup, candidates))
+	assert.False(l.keepsPin(primary, candidates))
+}
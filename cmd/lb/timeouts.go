@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// duration is a time.Duration that reads from JSON strings such as "1.5s".
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+// timeoutConfig splits an upstream exchange into phases with their own
+// deadlines. Total bounds everything up to the response headers, zero
+// values leave a phase bounded by it only. The body is only bounded by
+// IdleBody, so streams last as long as data keeps coming.
+type timeoutConfig struct {
+	Dial           duration `json:"dial,omitempty"`
+	TLSHandshake   duration `json:"tlsHandshake,omitempty"`
+	ResponseHeader duration `json:"responseHeader,omitempty"`
+	IdleBody       duration `json:"idleBody,omitempty"`
+	Total          duration `json:"total,omitempty"`
+}
+
+func (t timeoutConfig) validate() error {
+	for _, d := range []duration{t.Dial, t.TLSHandshake, t.ResponseHeader, t.IdleBody, t.Total} {
+		if d < 0 {
+			return fmt.Errorf("timeouts must not be negative, got %s", time.Duration(d))
+		}
+	}
+	return nil
+}
+
+// merge returns t with every phase set in override replaced.
+func (t timeoutConfig) merge(override timeoutConfig) timeoutConfig {
+	pick := func(base, o duration) duration {
+		if o > 0 {
+			return o
+		}
+		return base
+	}
+	return timeoutConfig{
+		Dial:           pick(t.Dial, override.Dial),
+		TLSHandshake:   pick(t.TLSHandshake, override.TLSHandshake),
+		ResponseHeader: pick(t.ResponseHeader, override.ResponseHeader),
+		IdleBody:       pick(t.IdleBody, override.IdleBody),
+		Total:          pick(t.Total, override.Total),
+	}
+}
+
+type timeoutError struct {
+	phase string
+	err   error
+}
+
+func (e *timeoutError) Error() string { return fmt.Sprintf("%s timeout: %s", e.phase, e.err) }
+func (e *timeoutError) Unwrap() error { return e.err }
+func (e *timeoutError) Timeout() bool { return true }
+
+// abortError is a failure after the response headers were sent, too late
+// for anything but cutting the client connection.
+type abortError struct {
+	err error
+}
+
+func (e *abortError) Error() string { return fmt.Sprintf("response aborted: %s", e.err) }
+func (e *abortError) Unwrap() error { return e.err }
+
+func isTimeout(err error) bool {
+	var te *timeoutError
+	return errors.As(err, &te)
+}
+
+type timeoutsKey struct{}
+
+func withTimeouts(ctx context.Context, t timeoutConfig) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, t)
+}
+
+func timeoutsFrom(ctx context.Context) timeoutConfig {
+	t, _ := ctx.Value(timeoutsKey{}).(timeoutConfig)
+	return t
+}
+
+// phaseTimer cancels an upstream exchange when one of its phases takes
+// too long and remembers which phase it was.
+type phaseTimer struct {
+	cancel context.CancelFunc
+
+	mux     sync.Mutex
+	timer   *time.Timer
+	expired string
+}
+
+func (p *phaseTimer) start(phase string, d duration) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+	}
+	if d <= 0 {
+		p.timer = nil
+		return
+	}
+	p.timer = time.AfterFunc(time.Duration(d), func() {
+		p.mux.Lock()
+		p.expired = phase
+		p.mux.Unlock()
+		p.cancel()
+	})
+}
+
+func (p *phaseTimer) stop() {
+	p.start("", 0)
+}
+
+// wrap turns an error caused by an expired phase or by the overall
+// deadline into a timeoutError.
+func (p *phaseTimer) wrap(ctx context.Context, err error) error {
+	if err == nil || isTimeout(err) {
+		return err
+	}
+	p.mux.Lock()
+	phase := p.expired
+	p.mux.Unlock()
+	if phase != "" {
+		return &timeoutError{phase: phase, err: err}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &timeoutError{phase: "request", err: err}
+	}
+	return err
+}
+
+// trace starts the response header phase once the request is written.
+func (p *phaseTimer) trace(ctx context.Context, t timeoutConfig) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			p.start("response header", t.ResponseHeader)
+		},
+	})
+}
+
+// idleReader restarts the idle body phase on every read.
+type idleReader struct {
+	io.ReadCloser
+	timer *phaseTimer
+	idle  duration
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.timer.start("idle body", r.idle)
+	n, err := r.ReadCloser.Read(p)
+	r.timer.stop()
+	return n, err
+}
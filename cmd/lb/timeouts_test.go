@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	var tc timeoutConfig
+	assert.Nil(json.Unmarshal([]byte(`{"dial": "250ms", "total": "5s"}`), &tc))
+	assert.Equal(duration(250*time.Millisecond), tc.Dial)
+
+	merged := timeoutConfig{Dial: duration(time.Second), IdleBody: duration(time.Second)}.merge(tc)
+	assert.Equal(duration(250*time.Millisecond), merged.Dial)
+	assert.Equal(duration(time.Second), merged.IdleBody)
+	assert.Equal(duration(5*time.Second), merged.Total)
+
+	assert.NotNil(json.Unmarshal([]byte(`{"dial": "soon"}`), &tc))
+	assert.NotNil(timeoutConfig{Dial: -1}.validate())
+}
+
+func TestRouteMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	table := new(routeTable)
+	assert.Equal(defaultRoute, table.match("/api"))
+
+	table.set([]routeConfig{{Prefix: "/api"}, {Prefix: "/api/v1/slow"}})
+	assert.Equal("/api/v1/slow", table.match("/api/v1/slow/data").Prefix)
+	assert.Equal("/api", table.match("/api/v1/some-data").Prefix)
+	assert.Equal(defaultRoute, table.match("/report"))
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	defer func(old []*server) { serversPool = old }(serversPool)
+	serversPool = parseHosts(backendHost(backend))
+	defer routes.set(nil)
+	routes.set([]routeConfig{{
+		Prefix:   "/slow",
+		Timeouts: timeoutConfig{ResponseHeader: duration(20 * time.Millisecond)},
+	}})
+
+	rw := httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/slow", nil))
+	assert.Equal(http.StatusGatewayTimeout, rw.Code)
+
+	rw = httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/fast", nil))
+	assert.Equal(http.StatusOK, rw.Code)
+}
+
+func TestIdleBodyTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("first"))
+		rw.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		_, _ = rw.Write([]byte("second"))
+	}))
+	defer backend.Close()
+
+	info := &requestInfo{
+		span:     tracer.Start("test", tracing.KindInternal, tracing.SpanContext{}),
+		timeouts: timeoutConfig{IdleBody: duration(20 * time.Millisecond), Total: duration(time.Second)},
+	}
+	rw := httptest.NewRecorder()
+	err := forward(&server{host: backendHost(backend)}, rw, httptest.NewRequest("GET", "/", nil), info)
+	var aborted *abortError
+	assert.True(errors.As(err, &aborted))
+	assert.True(isTimeout(err))
+	assert.Equal("first", rw.Body.String())
+}
+
+func TestTotalTimeoutEndsAtHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 5; i++ {
+			_, _ = rw.Write([]byte("chunk"))
+			rw.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer backend.Close()
+
+	info := &requestInfo{
+		span:     tracer.Start("test", tracing.KindInternal, tracing.SpanContext{}),
+		timeouts: timeoutConfig{IdleBody: duration(time.Second), Total: duration(50 * time.Millisecond)},
+	}
+	rw := httptest.NewRecorder()
+	err := forward(&server{host: backendHost(backend)}, rw, httptest.NewRequest("GET", "/", nil), info)
+	assert.Nil(err)
+	assert.Equal(strings.Repeat("chunk", 5), rw.Body.String())
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
+)
+
+const (
+	// inheritedEnv names the sockets passed to an upgraded process, in
+	// the order of their descriptors from 3 on.
+	inheritedEnv = "LB_INHERITED_SOCKETS"
+	// upgradeReadyEnv is the descriptor an upgraded process reports on
+	// once it is serving.
+	upgradeReadyEnv = "LB_UPGRADE_READY_FD"
+
+	socketListen = "listen"
+	socketAdmin  = "admin"
+	socketGossip = "gossip"
+
+	upgradeReadyTimeout = 30 * time.Second
+)
+
+type fileSocket interface {
+	File() (*os.File, error)
+}
+
+type sharedSocket struct {
+	name   string
+	socket fileSocket
+}
+
+var (
+	sharedMux sync.Mutex
+	shared    []sharedSocket
+	inherited = inheritedSockets()
+)
+
+// inheritedSockets reads the sockets passed by the process that started
+// this one, if it was an upgrade.
+func inheritedSockets() map[string][]*os.File {
+	res := make(map[string][]*os.File)
+	names := os.Getenv(inheritedEnv)
+	if names == "" {
+		return res
+	}
+	os.Unsetenv(inheritedEnv)
+	for i, name := range strings.Split(names, ",") {
+		res[name] = append(res[name], os.NewFile(uintptr(3+i), name))
+	}
+	return res
+}
+
+// takeInherited returns the inherited sockets called name, only once.
+func takeInherited(name string) []*os.File {
+	sharedMux.Lock()
+	defer sharedMux.Unlock()
+	files := inherited[name]
+	delete(inherited, name)
+	return files
+}
+
+// share registers a socket to pass on to an upgraded process.
+func share(name string, socket fileSocket) {
+	sharedMux.Lock()
+	defer sharedMux.Unlock()
+	shared = append(shared, sharedSocket{name: name, socket: socket})
+}
+
+// listenAll opens the frontend listeners, or takes them over from the
+// process this one upgraded.
+func listenAll(specs []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	if files := takeInherited(socketListen); len(files) > 0 {
+		for _, f := range files {
+			l, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+			listeners = append(listeners, l)
+		}
+	} else {
+		var err error
+		if listeners, err = httptools.ListenAll(specs); err != nil {
+			return nil, err
+		}
+	}
+	for _, l := range listeners {
+		share(socketListen, l.(fileSocket))
+	}
+	return listeners, nil
+}
+
+func listenAdmin(port int) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if files := takeInherited(socketAdmin); len(files) > 0 {
+		l, err = net.FileListener(files[0])
+		files[0].Close()
+	} else {
+		l, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	}
+	if err != nil {
+		return nil, err
+	}
+	share(socketAdmin, l.(fileSocket))
+	return l, nil
+}
+
+func listenGossip(listen string) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	if files := takeInherited(socketGossip); len(files) > 0 {
+		pc, err := net.FilePacketConn(files[0])
+		files[0].Close()
+		if err != nil {
+			return nil, err
+		}
+		conn = pc.(*net.UDPConn)
+	} else {
+		addr, err := net.ResolveUDPAddr("udp", listen)
+		if err != nil {
+			return nil, err
+		}
+		if conn, err = net.ListenUDP("udp", addr); err != nil {
+			return nil, err
+		}
+	}
+	share(socketGossip, conn)
+	return conn, nil
+}
+
+// upgrade starts the binary at the path of the running one with the same
+// arguments and passes it every shared socket. It returns once the new
+// process serves on them; on error this process carries on as before.
+func upgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	sharedMux.Lock()
+	var files []*os.File
+	var names []string
+	for _, s := range shared {
+		f, err := s.socket.File()
+		if err != nil {
+			sharedMux.Unlock()
+			closeFiles(files)
+			return err
+		}
+		files = append(files, f)
+		names = append(names, s.name)
+	}
+	sharedMux.Unlock()
+	defer closeFiles(files)
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		inheritedEnv+"="+strings.Join(names, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(3+len(files)))
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		// The pipe closes without data if the new process dies.
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+	select {
+	case err = <-result:
+	case <-time.After(upgradeReadyTimeout):
+		err = errors.New("timed out")
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return fmt.Errorf("new process %d did not get ready: %s", cmd.Process.Pid, err)
+	}
+	log.Printf("New process %d took over", cmd.Process.Pid)
+	return nil
+}
+
+// notifyReady tells the process this one upgraded that it can go.
+func notifyReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(upgradeReadyEnv)
+	f := os.NewFile(uintptr(fd), "ready")
+	_, _ = f.Write([]byte{1})
+	f.Close()
+}
+
+// keepUnixSockets stops listeners from removing their socket files on
+// close, which would pull them from under the new process.
+func keepUnixSockets(listeners []net.Listener) {
+	for _, l := range listeners {
+		if ul, ok := l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// drain waits for in-flight work of a process that handed its sockets
+// over, until ctx expires. HTTP servers close their listeners themselves,
+// TCP listeners are passed in.
+func drain(ctx context.Context, servers []httptools.Server, tcpListeners []net.Listener) {
+	for _, l := range tcpListeners {
+		l.Close()
+	}
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		s := s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				log.Printf("Failed to drain: %s", err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		waitTCPConns(ctx)
+	}()
+	wg.Wait()
+}
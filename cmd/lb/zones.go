@@ -0,0 +1,80 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+)
+
+const (
+	zoneLocal  = "local"
+	zoneRemote = "remote"
+)
+
+var zoneRequests = expvar.NewMap("lb_zone_requests_total")
+
+func init() {
+	expvar.Publish("lb_zone_spillover_ratio", expvar.Func(func() interface{} {
+		return zoneSpilloverRatio()
+	}))
+}
+
+// zoneSpilloverRatio is the share of requests served from other zones.
+func zoneSpilloverRatio() float64 {
+	var local, remote int64
+	if v, ok := zoneRequests.Get(zoneLocal).(*expvar.Int); ok {
+		local = v.Value()
+	}
+	if v, ok := zoneRequests.Get(zoneRemote).(*expvar.Int); ok {
+		remote = v.Value()
+	}
+	if local+remote == 0 {
+		return 0
+	}
+	return float64(remote) / float64(local+remote)
+}
+
+func validateZoneFlags() error {
+	if *zoneMinHealthy < 0 || *zoneMinHealthy > 1 {
+		return fmt.Errorf("-zone-min-healthy must be within [0, 1], got %v", *zoneMinHealthy)
+	}
+	if *zoneSpillover < 0 || *zoneSpillover > 1 {
+		return fmt.Errorf("-zone-spillover must be within [0, 1], got %v", *zoneSpillover)
+	}
+	return nil
+}
+
+// preferZone narrows candidates to the balancer's zone while enough of
+// its servers are healthy. Otherwise a -zone-spillover share of requests
+// goes to the other zones. The caller must hold backendLimiter.mux.
+func preferZone(candidates []*server) []*server {
+	if *zone == "" {
+		return candidates
+	}
+	var local, remote []*server
+	localUp, remoteUp := 0, 0
+	for _, s := range candidates {
+		if s.zone == *zone {
+			local = append(local, s)
+			if s.available() {
+				localUp++
+			}
+		} else {
+			remote = append(remote, s)
+			if s.available() {
+				remoteUp++
+			}
+		}
+	}
+	switch {
+	case localUp == 0:
+		return remote
+	case remoteUp == 0:
+		return local
+	case float64(localUp) >= *zoneMinHealthy*float64(len(local)):
+		return local
+	case rand.Float64() < *zoneSpillover:
+		return remote
+	}
+	return local
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreferZone(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(oldZone string, oldMin, oldSpillover float64) {
+		*zone, *zoneMinHealthy, *zoneSpillover = oldZone, oldMin, oldSpillover
+	}(*zone, *zoneMinHealthy, *zoneSpillover)
+	defer func() {
+		poolsMux.Lock()
+		delete(pools, "zoned")
+		poolsMux.Unlock()
+	}()
+	servers := setupPool("zoned", nil, poolConfig{
+		Servers: []string{"a1:8080", "a2:8080", "b1:8080"},
+		Zones:   map[string]string{"a1:8080": "a", "a2:8080": "a", "b1:8080": "b"},
+	})
+	a1, a2, b1 := servers[0], servers[1], servers[2]
+	assert.Equal("b", b1.zone)
+
+	*zone = ""
+	assert.Equal(servers, preferZone(servers), "zones are ignored without -zone")
+
+	*zone, *zoneMinHealthy, *zoneSpillover = "a", 0.6, 0
+	assert.Equal([]*server{a1, a2}, preferZone(servers))
+	a1.isHealthy = false
+	assert.Equal([]*server{a1, a2}, preferZone(servers), "spillover of 0 keeps requests local")
+	*zoneSpillover = 1
+	assert.Equal([]*server{b1}, preferZone(servers))
+	*zoneMinHealthy = 0.5
+	assert.Equal([]*server{a1, a2}, preferZone(servers))
+	a2.isHealthy = false
+	*zoneSpillover = 0
+	assert.Equal([]*server{b1}, preferZone(servers), "a zone with no healthy servers always spills over")
+	a2.isHealthy, b1.isHealthy = true, false
+	*zoneMinHealthy = 1
+	assert.Equal([]*server{a1, a2}, preferZone(servers))
+
+	*zoneSpillover = 2
+	assert.NotNil(validateZoneFlags())
+}
+
+func TestZoneSpilloverMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(oldZone string, oldMin, oldSpillover float64) {
+		*zone, *zoneMinHealthy, *zoneSpillover = oldZone, oldMin, oldSpillover
+	}(*zone, *zoneMinHealthy, *zoneSpillover)
+	*zone, *zoneMinHealthy, *zoneSpillover = "a", 1, 0.5
+
+	local := []*server{{host: "a1:8080", zone: "a", isHealthy: true}, {host: "a2:8080", zone: "a"}}
+	remote := &server{host: "b1:8080", zone: "b", isHealthy: true}
+	candidates := append(local, remote)
+	l := newLimiter(0, 0, 0)
+
+	zoneRequests.Init()
+	for i := 0; i < 1000; i++ {
+		dst, err := l.acquire(context.Background(), candidates)
+		assert.Nil(err)
+		l.release(dst)
+	}
+	assert.InDelta(0.5, zoneSpilloverRatio(), 0.1)
+
+	zoneRequests.Init()
+	local[1].isHealthy = true
+	dst, _ := l.acquire(context.Background(), candidates)
+	l.release(dst)
+	assert.Equal(0.0, zoneSpilloverRatio())
+}
+
+func TestPinnedFollowsZone(t *testing.T) {
+	assert := assert.New(t)
+
+	defer func(oldZone string, oldMin, oldSpillover float64) {
+		*zone, *zoneMinHealthy, *zoneSpillover = oldZone, oldMin, oldSpillover
+	}(*zone, *zoneMinHealthy, *zoneSpillover)
+	*zone, *zoneMinHealthy, *zoneSpillover = "a", 1, 0
+
+	local := &server{host: "a1:8080", zone: "a", isHealthy: true}
+	remote := &server{host: "b1:8080", zone: "b", isHealthy: true}
+	candidates := []*server{local, remote}
+	l := newLimiter(0, 0, 0)
+
+	assert.True(l.keepsPin(local, candidates))
+	assert.False(l.keepsPin(remote, candidates), "clients come back to the local zone once it recovers")
+	local.isHealthy = false
+	assert.True(l.keepsPin(remote, candidates))
+}
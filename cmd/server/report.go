@@ -4,20 +4,29 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
 )
 
 const reportMaxLen = 100
 
+// Report keeps the last requests of every author. An entry is the request
+// counter, followed by "@" and the request ID when the request has one.
 type Report map[string][]string
 
 func (r Report) Process(req *http.Request) {
 	author := req.Header.Get("lb-author")
 	counter := req.Header.Get("lb-req-cnt")
-	log.Printf("GET some-data from [%s] request [%s]", author, counter)
+	id := httptools.RequestID(req)
+	log.Printf("GET some-data from [%s] request [%s] id [%s]", author, counter, id)
 
 	if len(author) > 0 {
+		entry := counter
+		if id != "" {
+			entry += "@" + id
+		}
 		list := r[author]
-		list = append(list, counter)
+		list = append(list, entry)
 		if len(list) > reportMaxLen {
 			list = list[len(list)-reportMaxLen:]
 		}
@@ -4,6 +4,8 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"testing"
+
+	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
 )
 
 func TestReport_Process(t *testing.T) {
@@ -24,6 +26,14 @@ func TestReport_Process(t *testing.T) {
 		t.Errorf("Unexpected report state %s", r)
 	}
 
+	req.Header.Set(httptools.RequestIDHeader, "4bf92f3577b34da6")
+	req.Header.Set("lb-req-cnt", "3")
+	r.Process(req)
+	if !reflect.DeepEqual(r["test-author"], []string{"1", "2", "3@4bf92f3577b34da6"}) {
+		t.Errorf("Unexpected report state %s", r)
+	}
+	req.Header.Del(httptools.RequestIDHeader)
+
 	req.Header.Set("lb-author", "test-len")
 	for i := 0; i < 103; i++ {
 		req.Header.Set("lb-req-cnt", "test-len")
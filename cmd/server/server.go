@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -10,14 +11,26 @@ import (
 
 	"github.com/pavlovskyive/kpi-lab-2-balancer/httptools"
 	"github.com/pavlovskyive/kpi-lab-2-balancer/signal"
+	"github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var (
+	port        = flag.Int("port", 8080, "server port")
+	traceExport = flag.String("trace-export", "", "file path or OTLP/HTTP collector URL to export spans to")
+)
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
 func main() {
+	flag.Parse()
+
+	exporter, err := tracing.NewExporter(*traceExport)
+	if err != nil {
+		log.Fatalf("Failed to set up span export: %s", err)
+	}
+	tracer := tracing.NewTracer("server", exporter)
+
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -50,7 +63,8 @@ func main() {
 
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, tracer.Middleware("server", h))
 	server.Start()
 	signal.WaitForTerminationSignal()
+	tracer.Flush()
 }
@@ -2,4 +2,7 @@ module github.com/pavlovskyive/kpi-lab-2-balancer
 
 go 1.15
 
-require github.com/stretchr/testify v1.7.0
+require (
+	github.com/stretchr/testify v1.7.0
+	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+)
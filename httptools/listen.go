@@ -0,0 +1,66 @@
+package httptools
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	unixSpecPrefix = "unix:"
+	fdSpecPrefix   = "fd:"
+)
+
+// Listen opens a listener described by spec:
+//
+//	8080, :8080, 0.0.0.0:8080, [::1]:8080   TCP, IPv4 or IPv6
+//	unix:/run/app.sock                      Unix domain socket
+//	fd:3                                    an inherited socket, e.g. from
+//	                                        systemd socket activation
+//
+// A stale Unix socket file left by a previous run is removed first.
+func Listen(spec string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(spec, unixSpecPrefix):
+		path := strings.TrimPrefix(spec, unixSpecPrefix)
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.Dial("unix", path); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("%s is in use", path)
+			}
+			_ = os.Remove(path)
+		}
+		return net.Listen("unix", path)
+	case strings.HasPrefix(spec, fdSpecPrefix):
+		fd, err := strconv.Atoi(strings.TrimPrefix(spec, fdSpecPrefix))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("bad file descriptor in %q", spec)
+		}
+		f := os.NewFile(uintptr(fd), spec)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	if _, err := strconv.Atoi(spec); err == nil {
+		spec = ":" + spec
+	}
+	return net.Listen("tcp", spec)
+}
+
+// ListenAll opens every listener in specs, closing the opened ones if
+// one of them fails.
+func ListenAll(specs []string) ([]net.Listener, error) {
+	var res []net.Listener
+	for _, spec := range specs {
+		l, err := Listen(spec)
+		if err != nil {
+			for _, opened := range res {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("listen on %s: %s", spec, err)
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
@@ -0,0 +1,35 @@
+package httptools
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader carries the ID that follows a request from the client
+// through the balancer to the backend.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLen = 128
+
+// NewRequestID returns a random 16 hex digit ID.
+func NewRequestID() string {
+	var buf [8]byte
+	_, _ = rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+// RequestID returns the ID the request carries, or an empty string if it
+// has none or it is not a short line of printable ASCII.
+func RequestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if len(id) > maxRequestIDLen {
+		return ""
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return ""
+		}
+	}
+	return id
+}
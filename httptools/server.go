@@ -1,26 +1,64 @@
 package httptools
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"time"
 )
 
 type Server interface {
 	Start()
+	// Shutdown stops accepting connections and waits for the active ones
+	// to finish or ctx to expire.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
-	httpServer *http.Server
+	httpServer        *http.Server
+	certFile, keyFile string
+	listeners         []net.Listener
 }
 
 func (s server) Start() {
-	go func() {
-		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
-		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
-	}()
+	if len(s.listeners) == 0 {
+		go func() {
+			var err error
+			if s.certFile != "" {
+				log.Println("Staring the HTTPS server...")
+				err = s.httpServer.ListenAndServeTLS(s.certFile, s.keyFile)
+			} else {
+				log.Println("Staring the HTTP server...")
+				err = s.httpServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+			}
+		}()
+		return
+	}
+	for _, l := range s.listeners {
+		l := l
+		go func() {
+			var err error
+			if s.certFile != "" {
+				log.Printf("Staring the HTTPS server on %s...", l.Addr())
+				err = s.httpServer.ServeTLS(l, s.certFile, s.keyFile)
+			} else {
+				log.Printf("Staring the HTTP server on %s...", l.Addr())
+				err = s.httpServer.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+			}
+		}()
+	}
+}
+
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
 }
 
 func CreateServer(port int, handler http.Handler) Server {
@@ -34,3 +72,20 @@ func CreateServer(port int, handler http.Handler) Server {
 		},
 	}
 }
+
+// CreateTLSServer creates a server that speaks HTTPS and negotiates HTTP/2.
+func CreateTLSServer(port int, handler http.Handler, certFile, keyFile string) Server {
+	s := CreateServer(port, handler).(server)
+	s.certFile, s.keyFile = certFile, keyFile
+	return s
+}
+
+// CreateServerOn creates a server that accepts connections from every
+// listener, with HTTPS if certFile is not empty.
+func CreateServerOn(listeners []net.Listener, handler http.Handler, certFile, keyFile string) Server {
+	s := CreateServer(0, handler).(server)
+	s.httpServer.Addr = ""
+	s.listeners = listeners
+	s.certFile, s.keyFile = certFile, keyFile
+	return s
+}
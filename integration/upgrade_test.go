@@ -0,0 +1,151 @@
+package integration
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func buildBalancer(t *testing.T, out, version string) {
+	cmd := exec.Command("go", "build", "-o", out, "-ldflags", "-X main.version="+version, "../cmd/lb")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedVersion(adminAddress string) string {
+	resp, err := client.Get(adminAddress + "/debug/vars")
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	var vars struct {
+		Version string `json:"lb_version"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&vars)
+	return vars.Version
+}
+
+func TestZeroDowntimeUpgrade(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs the balancer")
+	}
+	assert := assert.New(t)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "test-upgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	binary := filepath.Join(dir, "lb")
+	buildBalancer(t, binary, "v1")
+	configPath := filepath.Join(dir, "config.json")
+	config := fmt.Sprintf(`{"pools": {"stable": {"servers": [%q]}}}`, backend.Listener.Addr().String())
+	if err := ioutil.WriteFile(configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	port, adminPort := freePort(t), freePort(t)
+	address := fmt.Sprintf("http://127.0.0.1:%d", port)
+	adminAddress := fmt.Sprintf("http://127.0.0.1:%d", adminPort)
+	old := exec.Command(binary,
+		"-listen", fmt.Sprintf("127.0.0.1:%d", port),
+		"-admin-port", fmt.Sprint(adminPort),
+		"-config", configPath,
+		"-drain-timeout", "5s",
+		"-access-log", filepath.Join(dir, "access.log"))
+	old.Stdout, old.Stderr = os.Stdout, os.Stderr
+	// The upgraded process joins the group, so both are stopped at the end.
+	old.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := old.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Kill(-old.Process.Pid, syscall.SIGTERM)
+	exited := make(chan struct{})
+	go func() {
+		_ = old.Wait()
+		close(exited)
+	}()
+
+	for i := 0; servedVersion(adminAddress) != "v1"; i++ {
+		if i == 50 {
+			t.Fatal("balancer did not start")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var sent, failed int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				atomic.AddInt64(&sent, 1)
+				resp, err := client.Get(address + "/api/v1/some-data")
+				if err != nil {
+					t.Log(err)
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+				_, _ = ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	buildBalancer(t, binary, "v2")
+	if err := old.Process.Signal(syscall.SIGUSR2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-exited:
+	case <-time.After(20 * time.Second):
+		t.Fatal("old process did not exit after the upgrade")
+	}
+	assert.Equal("v2", servedVersion(adminAddress))
+	time.Sleep(300 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	assert.Zero(atomic.LoadInt64(&failed), "of %d requests", atomic.LoadInt64(&sent))
+}
@@ -0,0 +1,18 @@
+package signal
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// OnUpgrade calls handler every time the process receives SIGUSR2.
+func OnUpgrade(handler func()) {
+	usr2Channel := make(chan os.Signal, 1)
+	signal.Notify(usr2Channel, syscall.SIGUSR2)
+	go func() {
+		for range usr2Channel {
+			handler()
+		}
+	}()
+}
@@ -0,0 +1,164 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const scopeName = "github.com/pavlovskyive/kpi-lab-2-balancer/tracing"
+
+type Exporter interface {
+	Export(service string, spans []*Span) error
+}
+
+// NewExporter returns an HTTP exporter for http(s) URLs and a file exporter
+// for anything else. An empty target disables exporting.
+func NewExporter(target string) (Exporter, error) {
+	if target == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		return &httpExporter{url: target, client: &http.Client{Timeout: 5 * time.Second}}, nil
+	}
+	f, err := os.OpenFile(target, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{out: f}, nil
+}
+
+// fileExporter writes one OTLP JSON request per line.
+type fileExporter struct {
+	mux sync.Mutex
+	out *os.File
+}
+
+func (e *fileExporter) Export(service string, spans []*Span) error {
+	data, err := json.Marshal(encodeOTLP(service, spans))
+	if err != nil {
+		return err
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	_, err = e.out.Write(append(data, '\n'))
+	return err
+}
+
+// httpExporter posts OTLP JSON to a collector, e.g. http://collector:4318/v1/traces.
+type httpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func (e *httpExporter) Export(service string, spans []*Span) error {
+	data, err := json.Marshal(encodeOTLP(service, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func encodeOTLP(service string, spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		encoded[i] = otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			TraceState:        s.Context.State,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+			Status:            otlpStatus{Code: s.status, Message: s.statusMessage},
+		}
+		if s.Parent.IsValid() {
+			encoded[i].ParentSpanID = s.Parent.String()
+		}
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttributes(map[string]string{"service.name": service})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: scopeName},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+func encodeAttributes(attributes map[string]string) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]otlpAttribute, len(keys))
+	for i, k := range keys {
+		res[i] = otlpAttribute{Key: k, Value: otlpValue{StringValue: attributes[k]}}
+	}
+	return res
+}
@@ -0,0 +1,157 @@
+package tracing
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+// Values follow the OTLP SpanKind enum.
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+const (
+	statusUnset = 0
+	statusOk    = 1
+	statusError = 2
+
+	batchSize     = 100
+	flushInterval = 1 * time.Second
+)
+
+type Span struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+
+	status        int
+	statusMessage string
+	tracer        *Tracer
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetError(message string) {
+	s.status = statusError
+	s.statusMessage = message
+}
+
+func (s *Span) SetOk() {
+	s.status = statusOk
+}
+
+// Finish records the end time and hands the span to the exporter.
+func (s *Span) Finish() {
+	s.End = time.Now()
+	s.tracer.enqueue(s)
+}
+
+// Tracer creates spans and exports them in batches. A tracer without an
+// exporter still propagates context but drops finished spans.
+type Tracer struct {
+	service  string
+	exporter Exporter
+
+	mux     sync.Mutex
+	pending []*Span
+}
+
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{service: service, exporter: exporter}
+	if exporter != nil {
+		go func() {
+			for range time.Tick(flushInterval) {
+				t.Flush()
+			}
+		}()
+	}
+	return t
+}
+
+// Start begins a span. When parent is valid the span joins its trace,
+// otherwise a new trace is started.
+func (t *Tracer) Start(name string, kind SpanKind, parent SpanContext) *Span {
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+	if parent.IsValid() {
+		s.Context = parent
+		s.Parent = parent.SpanID
+	} else {
+		s.Context = SpanContext{TraceID: newTraceID(), Flags: flagSampled}
+	}
+	s.Context.SpanID = newSpanID()
+	return s
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	if t.exporter == nil || s.Context.Flags&flagSampled == 0 {
+		return
+	}
+	t.mux.Lock()
+	t.pending = append(t.pending, s)
+	full := len(t.pending) >= batchSize
+	t.mux.Unlock()
+	if full {
+		go t.Flush()
+	}
+}
+
+// Flush synchronously exports every finished span.
+func (t *Tracer) Flush() {
+	t.mux.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mux.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.exporter.Export(t.service, spans); err != nil {
+		log.Printf("Failed to export %d spans: %s", len(spans), err)
+	}
+}
+
+// Middleware wraps a handler with a server span that joins the trace
+// propagated by the caller.
+func (t *Tracer) Middleware(name string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		parent, _ := Extract(r.Header)
+		span := t.Start(name, KindServer, parent)
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+		rec := &statusRecorder{ResponseWriter: rw, status: http.StatusOK}
+		handler.ServeHTTP(rec, r)
+		span.SetAttribute("http.status_code", strconv.Itoa(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetError(http.StatusText(rec.status))
+		}
+		span.Finish()
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type collectorStub struct {
+	requests chan otlpRequest
+}
+
+func newCollectorStub() (*collectorStub, *httptest.Server) {
+	c := &collectorStub{requests: make(chan otlpRequest, 10)}
+	return c, httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.requests <- req
+	}))
+}
+
+func TestParseTraceparent(t *testing.T) {
+	assert := assert.New(t)
+
+	sc, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.Nil(err)
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID.String())
+	assert.Equal("00f067aa0ba902b7", sc.SpanID.String())
+	assert.Equal(byte(1), sc.Flags)
+	assert.Equal("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", sc.Traceparent())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, err := ParseTraceparent(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestMiddlewareJoinsTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	collector, collectorServer := newCollectorStub()
+	defer collectorServer.Close()
+	exporter, err := NewExporter(collectorServer.URL)
+	assert.Nil(err)
+	tracer := &Tracer{service: "test", exporter: exporter}
+
+	handler := tracer.Middleware("test", http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {
+		rw.WriteHeader(http.StatusTeapot)
+	}))
+	req := httptest.NewRequest("GET", "/some-data", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(TracestateHeader, "vendor=value")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	tracer.Flush()
+
+	exported := <-collector.requests
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	assert.Len(spans, 1)
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", spans[0].TraceID)
+	assert.Equal("00f067aa0ba902b7", spans[0].ParentSpanID)
+	assert.Equal("vendor=value", spans[0].TraceState)
+	assert.Equal(KindServer, spans[0].Kind)
+	assert.Contains(spans[0].Attributes, otlpAttribute{Key: "http.status_code", Value: otlpValue{StringValue: "418"}})
+}
+
+func TestStartNewTrace(t *testing.T) {
+	assert := assert.New(t)
+
+	tracer := NewTracer("test", nil)
+	span := tracer.Start("root", KindInternal, SpanContext{})
+	assert.True(span.Context.IsValid())
+	assert.False(span.Parent.IsValid())
+
+	child := tracer.Start("child", KindClient, span.Context)
+	assert.Equal(span.Context.TraceID, child.Context.TraceID)
+	assert.Equal(span.Context.SpanID, child.Parent)
+
+	h := make(http.Header)
+	Inject(h, child.Context)
+	extracted, ok := Extract(h)
+	assert.True(ok)
+	assert.Equal(child.Context, extracted)
+}